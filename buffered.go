@@ -0,0 +1,83 @@
+package lexer
+
+// BufferedTokens wraps the token stream of a Lexer allowing the consumer to
+// mark a point in the stream and later reset back to it. Tokens read since
+// the mark are buffered.
+type BufferedTokens struct {
+	l      *Lexer
+	buf    []Token
+	pos    int
+	from   int
+	marked bool
+	all    bool
+}
+
+// NewBufferedTokens creates a buffered consumer for the lexer's tokens.
+func NewBufferedTokens(l *Lexer) *BufferedTokens {
+	return &BufferedTokens{l: l}
+}
+
+// NewReplayTokens creates a buffered consumer which keeps every token read,
+// so that RestartStream can replay the stream from the first token. The
+// whole stream is held in memory for the life of the consumer.
+func NewReplayTokens(l *Lexer) *BufferedTokens {
+	return &BufferedTokens{l: l, all: true}
+}
+
+// NextToken returns the next token, replaying any buffered tokens first, and
+// done.
+func (b *BufferedTokens) NextToken() (*Token, bool) {
+	if b.pos < len(b.buf) {
+		tok := b.buf[b.pos]
+		b.pos++
+		return &tok, false
+	}
+	tok, done := b.l.NextToken()
+	if done {
+		return nil, true
+	}
+	if b.marked || b.all {
+		b.buf = append(b.buf, *tok)
+		b.pos++
+	}
+	return tok, false
+}
+
+// Mark records the current point in the stream, replacing any previous mark.
+func (b *BufferedTokens) Mark() {
+	b.drop()
+	b.from = b.pos
+	b.marked = true
+}
+
+// Reset rewinds the stream to the last mark.
+func (b *BufferedTokens) Reset() {
+	b.pos = b.from
+}
+
+// Release discards the mark. Tokens already buffered past the current point
+// are still returned.
+func (b *BufferedTokens) Release() {
+	b.drop()
+	b.from = b.pos
+	b.marked = false
+}
+
+// RestartStream rewinds the stream to the first token. It panics unless b
+// was created by NewReplayTokens.
+func (b *BufferedTokens) RestartStream() {
+	if !b.all {
+		panic("lexer: RestartStream requires NewReplayTokens")
+	}
+	b.pos = 0
+}
+
+// drop discards buffered tokens before the current point, unless every token
+// is kept.
+func (b *BufferedTokens) drop() {
+	if b.all {
+		return
+	}
+	b.buf = b.buf[b.pos:]
+	b.pos = 0
+}
@@ -0,0 +1,68 @@
+package lexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBufferedTokens(t *testing.T) {
+	l := New("123.hello  675.world", NumberState)
+	l.Start()
+	b := NewBufferedTokens(l)
+
+	next := func(expected string) {
+		t.Helper()
+		tok, done := b.NextToken()
+		if done {
+			t.Fatalf("Expected %q but lexer finished", expected)
+		}
+		if tok.Value != expected {
+			t.Fatalf("Expected %q but got %q", expected, tok.Value)
+		}
+	}
+
+	next("123")
+	b.Mark()
+	next(".")
+	next("hello")
+	b.Reset()
+	next(".")
+	next("hello")
+	next("675")
+	b.Release()
+	b.Mark()
+	next(".")
+	b.Reset()
+	next(".")
+	next("world")
+
+	if _, done := b.NextToken(); !done {
+		t.Fatal("Expected done but it wasn't.")
+	}
+}
+
+func TestRestartStream(t *testing.T) {
+	l := New("123.hello  675.world", NumberState)
+	l.Start()
+	b := NewReplayTokens(l)
+
+	read := func() []Token {
+		var toks []Token
+		for tok, done := b.NextToken(); !done; tok, done = b.NextToken() {
+			toks = append(toks, *tok)
+		}
+		return toks
+	}
+
+	b.NextToken()
+	b.Mark()
+	b.NextToken()
+	b.Reset()
+	b.RestartStream()
+	first := read()
+	b.RestartStream()
+	second := read()
+	if len(first) != 6 || !reflect.DeepEqual(first, second) {
+		t.Fatalf("Expected %v but got %v", first, second)
+	}
+}
@@ -0,0 +1,47 @@
+package lexer
+
+// Builder configures and creates a Lexer using chained calls, as an
+// alternative to passing options to New.
+type Builder struct {
+	src   string
+	start StateFunc
+	opts  []Option
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Source sets the source to lex.
+func (b *Builder) Source(src string) *Builder {
+	b.src = src
+	return b
+}
+
+// Start sets the initial state.
+func (b *Builder) Start(start StateFunc) *Builder {
+	b.start = start
+	return b
+}
+
+// BufferSize sets the size of the token channel buffer.
+func (b *Builder) BufferSize(n int) *Builder {
+	return b.With(WithBufferSize(n))
+}
+
+// StrictUTF8 treats invalid UTF-8 as an error.
+func (b *Builder) StrictUTF8() *Builder {
+	return b.With(WithStrictUTF8())
+}
+
+// With adds arbitrary options.
+func (b *Builder) With(opts ...Option) *Builder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// Build creates the Lexer.
+func (b *Builder) Build() *Lexer {
+	return New(b.src, b.start, b.opts...)
+}
@@ -0,0 +1,37 @@
+package lexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	l := NewBuilder().
+		Source("123.hello").
+		Start(NumberState).
+		BufferSize(7).
+		StrictUTF8().
+		With(WithZeroBased()).
+		Build()
+
+	if !l.strictUTF8 || !l.zeroBased {
+		t.Fatal("Expected options to be set")
+	}
+	l.Start()
+	if cap(l.tokens) != 7 {
+		t.Fatalf("Expected a buffer of 7 but got %d", cap(l.tokens))
+	}
+	expected := []string{"0:123", "1:.", "2:hello"}
+	if s := Signatures(collect(l)); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected %q but got %q", expected, s)
+	}
+}
+
+func TestStrictUTF8(t *testing.T) {
+	l := NewBuilder().Source("12\xff3").Start(NumberState).StrictUTF8().Build()
+	l.Start()
+	toks := collect(l)
+	if len(toks) != 2 || toks[0].Value != "12" || toks[1].Type != ErrorToken {
+		t.Fatalf("Expected a number then an error but got %v", toks)
+	}
+}
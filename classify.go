@@ -0,0 +1,67 @@
+package lexer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// RuneClass is a broad category of rune used for dispatch.
+type RuneClass int
+
+const (
+	// ClassOther is any rune not in another class
+	ClassOther RuneClass = iota
+	// ClassDigit is a decimal digit
+	ClassDigit
+	// ClassLetter is a letter
+	ClassLetter
+	// ClassSpace is whitespace
+	ClassSpace
+	// ClassOperator is punctuation or a symbol
+	ClassOperator
+	// ClassEOF is EOFRune
+	ClassEOF
+)
+
+var asciiClasses [utf8.RuneSelf]RuneClass
+
+func init() {
+	for i := range asciiClasses {
+		asciiClasses[i] = classify(rune(i))
+	}
+}
+
+// Classify returns the class of r. ASCII runes are classified by table
+// lookup.
+func Classify(r rune) RuneClass {
+	if r >= 0 && r < utf8.RuneSelf {
+		return asciiClasses[r]
+	}
+	return classify(r)
+}
+
+func classify(r rune) RuneClass {
+	switch {
+	case r == EOFRune:
+		return ClassEOF
+	case unicode.IsDigit(r):
+		return ClassDigit
+	case unicode.IsLetter(r):
+		return ClassLetter
+	case unicode.IsSpace(r):
+		return ClassSpace
+	case unicode.IsPunct(r) || unicode.IsSymbol(r):
+		return ClassOperator
+	}
+	return ClassOther
+}
+
+// EmitAndDispatch emits the current value as type t and returns the state in
+// table for the class of the next rune, or def if there is none.
+func (l *Lexer) EmitAndDispatch(t TokenType, table map[RuneClass]StateFunc, def StateFunc) StateFunc {
+	l.Emit(t)
+	if next, ok := table[Classify(l.Peek())]; ok {
+		return next
+	}
+	return def
+}
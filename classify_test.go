@@ -0,0 +1,73 @@
+package lexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		r        rune
+		expected RuneClass
+	}{
+		{'7', ClassDigit},
+		{'a', ClassLetter},
+		{'Z', ClassLetter},
+		{' ', ClassSpace},
+		{'\n', ClassSpace},
+		{'+', ClassOperator},
+		{'(', ClassOperator},
+		{0, ClassOther},
+		{EOFRune, ClassEOF},
+		{'é', ClassLetter},
+		{'٣', ClassDigit},
+		{' ', ClassSpace},
+		{'€', ClassOperator},
+	}
+
+	for _, c := range cases {
+		if class := Classify(c.r); class != c.expected {
+			t.Fatalf("%q: expected %d but got %d", c.r, c.expected, class)
+		}
+	}
+}
+
+const classifyInput = "func main() { x := 42 + y_1; return x }\n"
+
+func BenchmarkClassify(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, r := range classifyInput {
+			Classify(r)
+		}
+	}
+}
+
+func BenchmarkClassifyUnicode(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, r := range classifyInput {
+			classify(r)
+		}
+	}
+}
+
+func TestEmitAndDispatch(t *testing.T) {
+	var table map[RuneClass]StateFunc
+	run := func(valid string, typ TokenType) StateFunc {
+		return func(l *Lexer) StateFunc {
+			l.AcceptRun(valid)
+			return l.EmitAndDispatch(typ, table, nil)
+		}
+	}
+	table = map[RuneClass]StateFunc{
+		ClassDigit:    run("0123456789", NumberToken),
+		ClassLetter:   run("abcdefghijklmnopqrstuvwxyz", IdentToken),
+		ClassOperator: run("+-*/=", OpToken),
+	}
+
+	toks := New("12ab+3=x ignored", table[ClassDigit]).All()
+	got := Signatures(toks)
+	expected := []string{"0:12", "2:ab", "1:+", "0:3", "1:=", "2:x"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v but got %v", expected, got)
+	}
+}
@@ -0,0 +1,64 @@
+package lexer
+
+import (
+	"unicode/utf8"
+)
+
+// DefaultMaxCommentNesting is the default limit on the depth of nested
+// comments and balanced delimiters.
+const DefaultMaxCommentNesting = 256
+
+// AcceptComment consumes a comment delimited by open and close, such as "/*"
+// and "*/". With nested, each open within the comment must be matched by its
+// own close. Nothing is consumed, and false is returned, if the input does
+// not start with open or the comment is not closed. If nesting exceeds the
+// limit set by WithMaxCommentNesting an error is emitted as well.
+func (l *Lexer) AcceptComment(open, close string, nested bool) bool {
+	return l.acceptDelimited(open, close, nested)
+}
+
+// AcceptBalanced consumes a run of input enclosed by open and close, such as
+// '(' and ')', in which each open must be matched by its own close. It
+// otherwise behaves like AcceptComment with nesting.
+func (l *Lexer) AcceptBalanced(open, close rune) bool {
+	return l.acceptDelimited(string(open), string(close), true)
+}
+
+// acceptDelimited implements AcceptComment, counting nesting depth rather
+// than recursing so that deep input cannot exhaust the stack.
+func (l *Lexer) acceptDelimited(open, close string, nested bool) bool {
+	if !l.AcceptString(open) {
+		return false
+	}
+	openRunes, closeRunes := utf8.RuneCountInString(open), utf8.RuneCountInString(close)
+	n, depth := openRunes, 1
+	for depth > 0 {
+		switch {
+		case l.AcceptString(close):
+			n += closeRunes
+			depth--
+		case nested && l.AcceptString(open):
+			n += openRunes
+			depth++
+			if depth > l.maxNesting {
+				l.backupN(n)
+				l.Error("maximum comment nesting %d exceeded", l.maxNesting)
+				return false
+			}
+		default:
+			n++
+			if l.Next() == EOFRune {
+				l.backupN(n)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// backupN calls Backup n times.
+func (l *Lexer) backupN(n int) {
+	for ; n > 0; n-- {
+		l.Backup()
+	}
+}
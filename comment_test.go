@@ -0,0 +1,76 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAcceptComment(t *testing.T) {
+	cases := []struct {
+		src      string
+		nested   bool
+		expected string
+		ok       bool
+	}{
+		{"/* a */ b", false, "/* a */", true},
+		{"/* a /* b */ c */", false, "/* a /* b */", true},
+		{"/* a /* b */ c */ d", true, "/* a /* b */ c */", true},
+		{"/* a /* b */", true, "", false},
+		{"/* a", false, "", false},
+		{"a /* */", false, "", false},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		ok := l.AcceptComment("/*", "*/", c.nested)
+		if ok != c.ok || l.Current() != c.expected {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.expected, c.ok, l.Current(), ok)
+		}
+	}
+}
+
+func TestAcceptBalanced(t *testing.T) {
+	l := New("(a(b)(c))d", nil)
+	if !l.AcceptBalanced('(', ')') || l.Current() != "(a(b)(c))" {
+		t.Fatalf("Expected %q but got %q", "(a(b)(c))", l.Current())
+	}
+	if r := l.Next(); r != 'd' {
+		t.Fatalf("Expected 'd' but got %q", r)
+	}
+}
+
+func TestMaxCommentNesting(t *testing.T) {
+	cases := []struct {
+		src string
+		ok  bool
+	}{
+		{"(())", true},
+		{"((()))", false},
+	}
+
+	for _, c := range cases {
+		var s SliceEmitter
+		l := New(c.src, nil, WithEmitter(&s), WithMaxCommentNesting(2))
+		ok := l.AcceptBalanced('(', ')')
+		if ok != c.ok {
+			t.Fatalf("%q: expected %t but got %t", c.src, c.ok, ok)
+		}
+		if c.ok {
+			if len(s.Tokens) != 0 {
+				t.Fatalf("%q: expected no tokens but got %v", c.src, s.Tokens)
+			}
+			continue
+		}
+		if len(s.Tokens) != 1 || s.Tokens[0].Value != "maximum comment nesting 2 exceeded" {
+			t.Fatalf("%q: expected a nesting error but got %v", c.src, s.Tokens)
+		}
+		if l.Current() != "" {
+			t.Fatalf("%q: expected nothing consumed but got %q", c.src, l.Current())
+		}
+	}
+
+	l := New(strings.Repeat("/*", 100000), nil, WithEmitter(&SliceEmitter{}))
+	if l.AcceptComment("/*", "*/", true) {
+		t.Fatal("Expected deep nesting to fail")
+	}
+}
@@ -0,0 +1,24 @@
+package lexer
+
+// Emitter receives the tokens produced by a Lexer.
+type Emitter interface {
+	Emit(Token)
+}
+
+// EmitterFunc adapts a function to an Emitter.
+type EmitterFunc func(Token)
+
+// Emit calls f(t).
+func (f EmitterFunc) Emit(t Token) {
+	f(t)
+}
+
+// SliceEmitter collects tokens in order.
+type SliceEmitter struct {
+	Tokens []Token
+}
+
+// Emit appends t to the collected tokens.
+func (s *SliceEmitter) Emit(t Token) {
+	s.Tokens = append(s.Tokens, t)
+}
@@ -0,0 +1,32 @@
+package lexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSliceEmitter(t *testing.T) {
+	var s SliceEmitter
+	l := New("123.hello  675.world", NumberState, WithEmitter(&s))
+	l.StartSync()
+
+	if _, done := l.NextToken(); !done {
+		t.Fatal("Expected no tokens on the channel")
+	}
+	expected := []string{"0:123", "1:.", "2:hello", "0:675", "1:.", "2:world"}
+	if !reflect.DeepEqual(Signatures(s.Tokens), expected) {
+		t.Fatalf("Expected %q but got %q", expected, Signatures(s.Tokens))
+	}
+}
+
+func TestEmitterFunc(t *testing.T) {
+	var values []string
+	l := New("notaspace", WhitespaceState, WithEmitter(EmitterFunc(func(tok Token) {
+		values = append(values, tok.Value)
+	})))
+	l.StartSync()
+
+	if !reflect.DeepEqual(values, []string{`unexpected token 'n'`}) {
+		t.Fatalf("Expected an error but got %q", values)
+	}
+}
@@ -0,0 +1,38 @@
+package lexer
+
+import (
+	"errors"
+	"strings"
+)
+
+// Encoding is a text encoding identified by a byte order mark.
+type Encoding int
+
+const (
+	// EncodingUTF8 is UTF-8, with or without a byte order mark
+	EncodingUTF8 Encoding = iota
+	// EncodingUTF16LE is little endian UTF-16
+	EncodingUTF16LE
+	// EncodingUTF16BE is big endian UTF-16
+	EncodingUTF16BE
+)
+
+// ErrUnsupportedEncoding is returned by DetectEncoding for input which is not
+// UTF-8.
+var ErrUnsupportedEncoding = errors.New("unsupported encoding")
+
+// DetectEncoding inspects any byte order mark at the current position, which
+// is normally the start of the input. Input without one is taken to be UTF-8.
+// UTF-16 is reported along with ErrUnsupportedEncoding as only UTF-8 can be
+// lexed. Nothing is consumed.
+func (l *Lexer) DetectEncoding() (Encoding, error) {
+	l.fillBytes(3)
+	rest := l.source[l.position-l.offset:]
+	switch {
+	case strings.HasPrefix(rest, "\xff\xfe"):
+		return EncodingUTF16LE, ErrUnsupportedEncoding
+	case strings.HasPrefix(rest, "\xfe\xff"):
+		return EncodingUTF16BE, ErrUnsupportedEncoding
+	}
+	return EncodingUTF8, nil
+}
@@ -0,0 +1,37 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDetectEncoding(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected Encoding
+		err      error
+	}{
+		{"\xef\xbb\xbfabc", EncodingUTF8, nil},
+		{"\xff\xfea\x00", EncodingUTF16LE, ErrUnsupportedEncoding},
+		{"\xfe\xff\x00a", EncodingUTF16BE, ErrUnsupportedEncoding},
+		{"abc", EncodingUTF8, nil},
+		{"", EncodingUTF8, nil},
+	}
+
+	for _, c := range cases {
+		lexers := []*Lexer{
+			New(c.src, nil),
+			NewFromReader(iotest.OneByteReader(strings.NewReader(c.src)), nil),
+		}
+		for _, l := range lexers {
+			enc, err := l.DetectEncoding()
+			if enc != c.expected || err != c.err {
+				t.Fatalf("%q: expected %d, %v but got %d, %v", c.src, c.expected, c.err, enc, err)
+			}
+			if l.Pos().Offset != 0 {
+				t.Fatalf("%q: expected nothing consumed", c.src)
+			}
+		}
+	}
+}
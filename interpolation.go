@@ -0,0 +1,53 @@
+package lexer
+
+// InterpolationScanner tracks nested string interpolation, such as
+// "a ${ b + "c" } d", on behalf of state functions. It records the brace
+// depth within each open interpolation so the closing brace that resumes the
+// enclosing string can be recognised.
+type InterpolationScanner struct {
+	depths []int
+}
+
+// EnterInterpolation records the start of an interpolation within a string.
+func (s *InterpolationScanner) EnterInterpolation() {
+	s.depths = append(s.depths, 0)
+}
+
+// ExitInterpolation records the end of the innermost interpolation.
+func (s *InterpolationScanner) ExitInterpolation() {
+	if n := len(s.depths); n > 0 {
+		s.depths = s.depths[:n-1]
+	}
+}
+
+// InInterpolation reports whether any interpolation is open.
+func (s *InterpolationScanner) InInterpolation() bool {
+	return len(s.depths) > 0
+}
+
+// Depth returns the number of open interpolations.
+func (s *InterpolationScanner) Depth() int {
+	return len(s.depths)
+}
+
+// OpenBrace records an opening brace within the innermost interpolation.
+func (s *InterpolationScanner) OpenBrace() {
+	if n := len(s.depths); n > 0 {
+		s.depths[n-1]++
+	}
+}
+
+// CloseBrace records a closing brace. It returns true if the brace ends the
+// innermost interpolation, in which case the enclosing string resumes.
+func (s *InterpolationScanner) CloseBrace() bool {
+	n := len(s.depths)
+	if n == 0 {
+		return false
+	}
+	if s.depths[n-1] == 0 {
+		s.ExitInterpolation()
+		return true
+	}
+	s.depths[n-1]--
+	return false
+}
@@ -0,0 +1,119 @@
+package lexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	tQuote TokenType = iota + 1
+	tText
+	tInterpStart
+	tInterpEnd
+	tExprIdent
+	tExprOp
+)
+
+type interpLexer struct {
+	sc InterpolationScanner
+}
+
+func (il *interpLexer) topState(l *Lexer) StateFunc {
+	switch l.Next() {
+	case EOFRune:
+		return nil
+	case '"':
+		l.Emit(tQuote)
+		return il.stringState
+	}
+	return l.Error("expected string")
+}
+
+func (il *interpLexer) stringState(l *Lexer) StateFunc {
+	for {
+		switch l.Next() {
+		case EOFRune:
+			return l.Error("unterminated string")
+		case '"':
+			l.Backup()
+			l.ReclassifyAndEmit(tText)
+			l.Next()
+			l.Emit(tQuote)
+			if il.sc.InInterpolation() {
+				return il.exprState
+			}
+			return il.topState
+		case '$':
+			if l.Peek() == '{' {
+				l.Backup()
+				l.ReclassifyAndEmit(tText)
+				l.Next()
+				l.Next()
+				l.Emit(tInterpStart)
+				il.sc.EnterInterpolation()
+				return il.exprState
+			}
+		}
+	}
+}
+
+func (il *interpLexer) exprState(l *Lexer) StateFunc {
+	l.AcceptRun(" ")
+	l.Ignore()
+	switch r := l.Next(); {
+	case r == EOFRune:
+		return l.Error("unterminated interpolation")
+	case r == '"':
+		l.Emit(tQuote)
+		return il.stringState
+	case r == '{':
+		il.sc.OpenBrace()
+		l.Emit(tExprOp)
+	case r == '}':
+		if il.sc.CloseBrace() {
+			l.Emit(tInterpEnd)
+			return il.stringState
+		}
+		l.Emit(tExprOp)
+	case r >= 'a' && r <= 'z':
+		l.AcceptRun("abcdefghijklmnopqrstuvwxyz")
+		l.Emit(tExprIdent)
+	default:
+		l.Emit(tExprOp)
+	}
+	return il.exprState
+}
+
+func TestInterpolation(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected []string
+	}{
+		{
+			`"a ${ b + "c" } d"`,
+			[]string{`1:"`, "2:a ", "3:${", "5:b", "6:+", `1:"`, "2:c", `1:"`, "4:}", "2: d", `1:"`},
+		},
+		{
+			`"x${ "y${z}" }"`,
+			[]string{`1:"`, "2:x", "3:${", `1:"`, "2:y", "3:${", "5:z", "4:}", `1:"`, "4:}", `1:"`},
+		},
+		{
+			`"${ {a} }"`,
+			[]string{`1:"`, "3:${", "6:{", "5:a", "6:}", "4:}", `1:"`},
+		},
+	}
+
+	for _, c := range cases {
+		var s SliceEmitter
+		il := &interpLexer{}
+		l := New(c.src, il.topState, WithEmitter(&s))
+		l.StartSync()
+
+		if sigs := Signatures(s.Tokens); !reflect.DeepEqual(sigs, c.expected) {
+			t.Fatalf("%s: expected %q but got %q", c.src, c.expected, sigs)
+		}
+		if il.sc.InInterpolation() {
+			t.Fatalf("%s: expected all interpolations closed", c.src)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package lexer
 
 import (
-	"bytes"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -21,145 +24,1028 @@ const (
 	ErrorToken TokenType = -1
 	// EOFToken is return on EOF
 	EOFToken TokenType = 0
+	// TriviaToken is sent on the trivia channel for ignored input
+	TriviaToken TokenType = -2
+	// WhitespaceToken is emitted by SkipWhitespace when whitespace is significant
+	WhitespaceToken TokenType = -3
+	// InvalidRune is returned by Peek for invalid UTF-8 under PeekSentinel
+	InvalidRune rune = -2
 )
 
-var lineSep = []byte{'\n'}
+// PeekPolicy determines what Peek returns for invalid UTF-8.
+type PeekPolicy int
+
+const (
+	// PeekRuneError returns utf8.RuneError
+	PeekRuneError PeekPolicy = iota
+	// PeekSentinel returns InvalidRune
+	PeekSentinel
+	// PeekError emits an error token and returns EOFRune
+	PeekError
+)
+
+// EndMode determines how the end of the tokens is signalled.
+type EndMode int
+
+const (
+	// EndClose closes the tokens channel, so NextToken reports done
+	EndClose EndMode = iota
+	// EndToken ends the tokens with a single EOFToken, after which NextToken
+	// reports done. The EOFToken is not sent on the tokens channel, which is
+	// just closed
+	EndToken
+	// EndBoth emits an EOFToken and then closes the channel
+	EndBoth
+)
+
+// Position is a location in the source.
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+// String returns the position as "line:col".
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
 
 // Token is returned by the lexer.
 type Token struct {
-	Type     TokenType
-	Value    string
+	Type  TokenType
+	Value string
+	Start Position
+	End   Position
+
+	// Deprecated: use Start.Offset.
 	Position int
-	Line     int
+	// Deprecated: use Start.Line.
+	Line int
+	// Deprecated: use Start.Column.
+	Column int
+
+	// LineText is the source line on which the token starts, without its
+	// line ending, when configured with WithLineText.
+	LineText string
+
+	lazy *lazyValue
+}
+
+// lazyValue is a token value computed on first use.
+type lazyValue struct {
+	once    sync.Once
+	compute func() string
+	value   string
+}
+
+// Text returns the value of the token, computing it if it was emitted with
+// EmitLazy. The computation runs at most once, even if the token is copied
+// or read from several goroutines.
+func (t Token) Text() string {
+	if t.lazy == nil {
+		return t.Value
+	}
+	t.lazy.once.Do(func() {
+		t.lazy.value = t.lazy.compute()
+	})
+	return t.lazy.value
 }
 
 // String implements Stringer
 func (t Token) String() string {
-	return fmt.Sprintf("[%d] %s", t.Type, t.Value)
+	return fmt.Sprintf("[%s] %s", t.Type, t.Text())
+}
+
+// IsError reports whether the token is an error.
+func (t Token) IsError() bool {
+	return t.Type == ErrorToken
+}
+
+// IsEOF reports whether the token marks the end of the input.
+func (t Token) IsEOF() bool {
+	return t.Type == EOFToken
+}
+
+// Pos returns the start of the token. It formats as "line:col".
+func (t Token) Pos() Position {
+	return t.Start
+}
+
+// Signature returns the type and value of the token, ignoring its position.
+func (t Token) Signature() string {
+	return fmt.Sprintf("%d:%s", t.Type, t.Text())
+}
+
+// Signatures returns the signature of each token in order.
+func Signatures(tokens []Token) []string {
+	out := make([]string, len(tokens))
+	for i, t := range tokens {
+		out[i] = t.Signature()
+	}
+	return out
+}
+
+// Render concatenates the values of the tokens. Tokens including trivia
+// render the original source.
+func Render(tokens []Token) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString(t.Text())
+	}
+	return b.String()
 }
 
 // Lexer represents the lexer machine.
 type Lexer struct {
-	source     string
-	start      int
-	line       int
-	position   int
-	lastWidth  int
-	startState StateFunc
-	tokens     chan Token
-	history    stack
+	source      string
+	origin      int
+	start       int
+	line        int
+	startLine   int
+	col         int
+	position    int
+	lastWidth   int
+	startState  StateFunc
+	tokens      chan Token
+	history     stack
+	keywords    map[string]TokenType
+	trivia      chan Token
+	withTrivia  bool
+	strict      bool
+	foldKeys    bool
+	lines       []int
+	terminator  rune
+	emitter     Emitter
+	inlineTriv  bool
+	comment     string
+	bufSize     int
+	quit        chan struct{}
+	quitOnce    sync.Once
+	peekPolicy  PeekPolicy
+	flush       bool
+	flushType   TokenType
+	wsSignif    bool
+	lookahead   []Token
+	zeroBased   bool
+	strictUTF8  bool
+	invalid     bool
+	invalidAt   int
+	maxLines    int
+	reader      io.Reader
+	readBuf     []byte
+	readEOF     bool
+	readErr     error
+	offset      int
+	recent      [tokenHistorySize]Token
+	emitted     int
+	states      []StateFunc
+	maxDepth    int
+	intercept   EmitInterceptor
+	opts        []Option
+	boundary    func(string, int) bool
+	sent        int
+	stats       LexStats
+	sendTimeout time.Duration
+	endMode     EndMode
+	final       *Token
+	marks       int
+	keepFrom    int
+	last        *Token
+	lineText    bool
+	done        chan struct{}
+	uniBreaks   bool
+	retain      int
+	maxNesting  int
 }
 
+// EmitInterceptor is called by Emit with each token. It may modify the token
+// and returns false to drop it. The value of a token from EmitLazy must be
+// read with Text.
+type EmitInterceptor func(*Token) bool
+
+// DefaultMaxStateDepth is the default limit on states saved by PushState.
+const DefaultMaxStateDepth = 1024
+
+// tokenHistorySize is the number of tokens kept for TokenHistory.
+const tokenHistorySize = 16
+
 // New creates a returns a lexer ready to parse the given source code.
-func New(src string, start StateFunc) *Lexer {
-	return &Lexer{
+func New(src string, start StateFunc, opts ...Option) *Lexer {
+	l := &Lexer{
 		source:     src,
 		startState: start,
 		start:      0,
 		line:       1,
+		startLine:  1,
 		position:   0,
 		history:    newStack(),
+		terminator: EOFRune,
+		maxDepth:   DefaultMaxStateDepth,
+		maxNesting: DefaultMaxCommentNesting,
+		opts:       opts,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.foldKeys {
+		folded := make(map[string]TokenType, len(l.keywords))
+		for k, t := range l.keywords {
+			folded[strings.ToLower(k)] = t
+		}
+		l.keywords = folded
 	}
+	return l
+}
+
+// NewSub creates a lexer for the region full[start:end] which reports
+// positions and lines relative to the full document.
+func NewSub(full string, start, end int, startState StateFunc, opts ...Option) *Lexer {
+	l := New(full[:end], startState, opts...)
+	l.origin = start
+	l.Rewind()
+	return l
+}
+
+// Rewind returns the lexer to its initial state, keeping the source and start
+// state, so that it may be started again.
+func (l *Lexer) Rewind() {
+	if l.offset > 0 {
+		panic("lexer: cannot rewind a lexer whose input has been discarded")
+	}
+	l.start = l.origin
+	l.position = l.origin
+	l.line = 1
+	l.col = 0
+	l.lines = nil
+	prefix := l.slice(0, l.origin)
+	l.countLines(0, prefix)
+	l.trackColumn(prefix)
+	l.startLine = l.line
+	l.invalid = false
+	l.emitted = 0
+	l.states = nil
+	l.final = nil
+	l.history.clear()
+}
+
+// Reset replaces the source and start state, keeping the options, and
+// rewinds the lexer so that it may be started again on the new input. Tokens
+// not yet received from the previous run are discarded. It must not be called
+// while the lexer is running.
+func (l *Lexer) Reset(src string, start StateFunc) {
+	l.source = src
+	l.startState = start
+	l.origin = 0
+	l.offset = 0
+	l.reader = nil
+	l.readEOF = false
+	l.readErr = nil
+	l.marks = 0
+	l.lookahead = nil
+	l.tokens = nil
+	l.trivia = nil
+	l.stats = LexStats{}
+	l.Rewind()
 }
 
 // Start begins executing the Lexer in an asynchronous manner (using a goroutine).
 func (l *Lexer) Start() {
-	go l.StartSync()
+	l.prepare()
+	go l.run()
 }
 
 // StartSync starts the lexer synchronously.
 func (l *Lexer) StartSync() {
+	l.prepare()
+	l.run()
+}
+
+// prepare creates the token channel. It must happen before any goroutine is
+// started so that consumers never read from a nil channel.
+func (l *Lexer) prepare() {
 	// Take half the string length as a buffer size.
-	buffSize := len(l.source) / 2
+	buffSize := l.bufSize
+	if buffSize <= 0 {
+		buffSize = len(l.source) / 2
+	}
 	if buffSize <= 0 {
 		buffSize = 1
 	}
+	l.quit = make(chan struct{})
+	l.quitOnce = sync.Once{}
+	l.done = make(chan struct{})
 	l.tokens = make(chan Token, buffSize)
-	l.run()
+	if l.withTrivia {
+		l.trivia = make(chan Token, buffSize)
+	}
 }
 
+// run executes the states and then closes the channels. A panic in a state
+// is reported as an error. The channels are captured first, as the lexer may
+// be restarted as soon as the tokens channel is closed.
 func (l *Lexer) run() {
+	tokens, trivia, done := l.tokens, l.trivia, l.done
+	if l.runStates() && l.flush && l.start < l.position && !l.stopped() {
+		l.Emit(l.flushType)
+	}
+	if l.invalid && !l.stopped() {
+		l.Error("invalid UTF-8 encoding at %d", l.invalidAt)
+	}
+	if l.readErr != nil && !l.stopped() {
+		l.Error("read error: %s", l.readErr)
+	}
+	if l.endMode != EndClose && !l.stopped() {
+		eof := l.tokenAt(EOFToken, "", l.position, l.position)
+		if l.endMode == EndBoth || l.emitter != nil {
+			l.send(eof)
+		} else {
+			l.final = &eof
+		}
+	}
+	close(tokens)
+	if trivia != nil {
+		close(trivia)
+	}
+	close(done)
+}
+
+// Done returns a channel which is closed once the lexer has finished and
+// closed the tokens channel. It is nil until the lexer is started.
+func (l *Lexer) Done() <-chan struct{} {
+	return l.done
+}
+
+// maxStalledStates is the number of states in a row which may run without
+// moving the position or emitting before the lexer is reported as stuck.
+const maxStalledStates = 64
+
+// runStates executes the states until one returns nil, returning false if
+// a state panicked. States which keep running without moving the position
+// or emitting would loop forever and are reported as an error instead.
+func (l *Lexer) runStates() (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+			l.Error("panic in state: %v", r)
+		}
+	}()
 	state := l.startState
-	for state != nil {
-		state = state(l)
+	stalled := 0
+	for state != nil && !l.stopped() {
+		from, sent := l.position, l.sent
+		next := state(l)
+		if next != nil && l.position == from && l.sent == sent {
+			stalled++
+			if stalled == maxStalledStates {
+				next = l.Error("lexer stuck at position %d", l.position)
+			}
+		} else {
+			stalled = 0
+		}
+		state = next
 	}
-	close(l.tokens)
+	return true
 }
 
 // Current returns the value being being analyzed at this moment.
 func (l *Lexer) Current() string {
-	return l.source[l.start:l.position]
+	return l.slice(l.start, l.position)
 }
 
 // Emit will receive a token type and push a new token with the current analyzed
-// value into the tokens channel.
+// value into the tokens channel. With strict token types an error is pushed
+// instead if t has not been registered. A configured EmitInterceptor is then
+// called before the token is recorded for TokenHistory and delivered.
 func (l *Lexer) Emit(t TokenType) {
+	l.EmitValue(t, l.Current())
+}
+
+// EmitValue is Emit with value in place of the current value. The token
+// still spans the current value, which is consumed.
+func (l *Lexer) EmitValue(t TokenType, value string) {
+	l.emit(l.token(t, value))
+}
+
+// EmitLazy is Emit with a value computed by compute when first read with
+// Token.Text. The Value field is left empty, so the value must be read with
+// Text, as String, Signature, Render and the other helpers do.
+func (l *Lexer) EmitLazy(t TokenType, compute func() string) {
+	tok := l.token(t, "")
+	tok.lazy = &lazyValue{compute: compute}
+	l.emit(tok)
+}
+
+// emit delivers tok and consumes the current value.
+func (l *Lexer) emit(tok Token) {
+	l.deliver(tok)
+	l.advance()
+}
+
+// deliver checks, intercepts and records tok before sending it. An error is
+// sent in its place if it has an unregistered type in strict mode.
+func (l *Lexer) deliver(tok Token) {
+	if l.strict && !registered(tok.Type) {
+		l.Error("unregistered token type %d", tok.Type)
+	} else if l.intercept == nil || l.intercept(&tok) {
+		l.record(tok)
+		l.send(tok)
+	}
+}
+
+// record adds tok to the ring of recently emitted tokens.
+func (l *Lexer) record(tok Token) {
+	l.recent[l.emitted%len(l.recent)] = tok
+	l.emitted++
+}
+
+// TokenHistory returns up to the last n tokens passed to Emit, oldest first.
+// Only the last 16 tokens are kept.
+func (l *Lexer) TokenHistory(n int) []Token {
+	if n < 0 {
+		n = 0
+	}
+	if n > l.emitted {
+		n = l.emitted
+	}
+	if n > len(l.recent) {
+		n = len(l.recent)
+	}
+	out := make([]Token, n)
+	for i := range out {
+		out[i] = l.recent[(l.emitted-n+i)%len(l.recent)]
+	}
+	return out
+}
+
+// EmitTrimmed is Emit with leading and trailing whitespace removed from the
+// value. The token still spans the whole current value.
+func (l *Lexer) EmitTrimmed(t TokenType) {
+	l.EmitValue(t, strings.TrimSpace(l.Current()))
+}
+
+// EmitSplit splits the current value on delim and emits each part as the
+// corresponding type in types. An error is emitted instead if the number of
+// parts does not match the number of types.
+func (l *Lexer) EmitSplit(delim rune, types ...TokenType) {
+	parts := strings.Split(l.Current(), string(delim))
+	if len(parts) != len(types) {
+		l.Error("expected %d parts but found %d", len(types), len(parts))
+		l.advance()
+		return
+	}
+	from := l.start
+	for i, p := range parts {
+		l.deliver(l.tokenAt(types[i], p, from, from+len(p)))
+		from += len(p) + utf8.RuneLen(delim)
+	}
+	l.advance()
+}
+
+// EmitMarker emits a token of type t with an empty value at the current
+// position. Nothing is consumed and the current value is unaffected.
+func (l *Lexer) EmitMarker(t TokenType) {
+	l.deliver(l.tokenAt(t, "", l.position, l.position))
+}
+
+// EmitOrEOF emits a token of type t and returns next, or nil if the end of
+// the input has been reached.
+func (l *Lexer) EmitOrEOF(t TokenType, next StateFunc) StateFunc {
+	l.Emit(t)
+	if l.Peek() == EOFRune {
+		return nil
+	}
+	return next
+}
+
+// EmitIf emits the current value as type t if cond is true. Otherwise the
+// position is returned to the start of the current value, discarding it.
+func (l *Lexer) EmitIf(cond bool, t TokenType) bool {
+	if cond {
+		l.Emit(t)
+		return true
+	}
+	for l.position > l.start && l.history.start != nil {
+		l.Backup()
+	}
+	return false
+}
+
+// ReclassifyAndEmit emits the current value as type t. It behaves like Emit
+// but makes explicit that lookahead has changed the kind of the already
+// scanned value. Nothing is emitted, and false is returned, if the current
+// value is empty.
+func (l *Lexer) ReclassifyAndEmit(t TokenType) bool {
+	if l.start == l.position {
+		return false
+	}
+	l.Emit(t)
+	return true
+}
+
+// send delivers a token to the emitter, or the tokens channel by default.
+func (l *Lexer) send(tok Token) {
+	l.sent++
+	if l.emitter != nil {
+		l.emitter.Emit(tok)
+		return
+	}
+	if l.sendTimeout > 0 {
+		l.sendWithTimeout(tok)
+		return
+	}
+	select {
+	case l.tokens <- tok:
+	case <-l.quit:
+	}
+}
+
+// sendWithTimeout is send giving up and stopping the lexer if the token has
+// not been received within the emit timeout. As the channel is full, the
+// error is left for NextToken to return once the channel is drained.
+func (l *Lexer) sendWithTimeout(tok Token) {
+	select {
+	case l.tokens <- tok:
+		return
+	default:
+	}
+	timer := time.NewTimer(l.sendTimeout)
+	defer timer.Stop()
+	select {
+	case l.tokens <- tok:
+	case <-l.quit:
+	case <-timer.C:
+		tok := l.token(ErrorToken, fmt.Sprintf("emit timed out after %s", l.sendTimeout))
+		l.final = &tok
+		l.stop()
+	}
+}
+
+// stop signals the lexer to stop running. Tokens are no longer delivered to
+// the channel. It does nothing if the lexer has not been started.
+func (l *Lexer) stop() {
+	if l.quit == nil {
+		return
+	}
+	l.quitOnce.Do(func() {
+		close(l.quit)
+	})
+}
+
+func (l *Lexer) stopped() bool {
+	select {
+	case <-l.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Lexer) token(t TokenType, value string) Token {
+	return l.tokenAt(t, value, l.start, l.position)
+}
+
+// tokenAt creates a token spanning from and to, which must be within the
+// current value.
+func (l *Lexer) tokenAt(t TokenType, value string, from, to int) Token {
+	start, end := l.posAt(from), l.posAt(to)
 	tok := Token{
 		Type:     t,
-		Value:    l.Current(),
-		Position: l.position,
-		Line:     l.line,
+		Value:    value,
+		Start:    start,
+		End:      end,
+		Position: start.Offset,
+		Line:     start.Line,
+		Column:   start.Column,
+	}
+	if l.lineText {
+		tok.LineText = l.lineTextAt(from)
+	}
+	return tok
+}
+
+// lineTextAt returns the line containing offset, without its line ending.
+func (l *Lexer) lineTextAt(offset int) string {
+	begin := l.lineStart(offset)
+	for l.reader != nil && !l.readEOF {
+		if i, _ := l.indexBreak(l.source[offset-l.offset:]); i >= 0 {
+			break
+		}
+		l.read()
+	}
+	text := l.source[begin-l.offset:]
+	if i, _ := l.indexBreak(text); i >= 0 {
+		text = text[:i]
 	}
-	l.tokens <- tok
-	l.checkLines()
+	return strings.TrimSuffix(text, "\r")
+}
+
+// lineStart returns the offset of the start of the line containing offset,
+// which must not be after the position.
+func (l *Lexer) lineStart(offset int) int {
+	if n := sort.SearchInts(l.lines, offset); n > 0 {
+		_, w := utf8.DecodeRuneInString(l.source[l.lines[n-1]-l.offset:])
+		return l.lines[n-1] + w
+	}
+	return 0
+}
+
+// lineBreakBefore returns the offset of the line break before offset, or 0
+// if there is none.
+func (l *Lexer) lineBreakBefore(offset int) int {
+	if n := sort.SearchInts(l.lines, offset); n > 0 {
+		return l.lines[n-1]
+	}
+	return 0
+}
+
+// Pos returns the current position. It formats as "line:col".
+func (l *Lexer) Pos() Position {
+	return l.posAt(l.position)
+}
+
+// posAt returns the position of offset, which must be within the current
+// value.
+func (l *Lexer) posAt(offset int) Position {
+	return Position{
+		Offset: offset,
+		Line:   l.startLine + l.countBreaks(l.slice(l.start, offset)) - 1 + l.base(),
+		Column: l.columnAt(offset),
+	}
+}
+
+// base returns the number of the first line and column.
+func (l *Lexer) base() int {
+	if l.zeroBased {
+		return 0
+	}
+	return 1
+}
+
+// advance moves the start past the current value.
+func (l *Lexer) advance() {
+	l.trackColumn(l.Current())
+	l.startLine = l.line
 	l.start = l.position
-	l.history.clear()
+	if l.retain > 0 {
+		l.history = l.history.keep(l.retain)
+	} else {
+		l.history.clear()
+	}
+	l.discard()
+}
+
+// countLines records the offset of each newline in val, which begins at
+// offset from.
+func (l *Lexer) countLines(from int, val string) {
+	for i, w := l.indexBreak(val); i >= 0; i, w = l.indexBreak(val) {
+		from += i
+		l.lines = append(l.lines, from)
+		l.line++
+		from += w
+		val = val[i+w:]
+	}
+}
+
+// isBreak reports whether r ends a line.
+func (l *Lexer) isBreak(r rune) bool {
+	return r == '\n' || l.uniBreaks && (r == '\u2028' || r == '\u2029')
+}
+
+// indexBreak returns the index and width of the first line break in s, or
+// -1 if there is none.
+func (l *Lexer) indexBreak(s string) (int, int) {
+	if !l.uniBreaks {
+		return strings.IndexByte(s, '\n'), 1
+	}
+	for i, r := range s {
+		if l.isBreak(r) {
+			return i, utf8.RuneLen(r)
+		}
+	}
+	return -1, 0
+}
+
+// lastBreak returns the index and width of the last line break in s, or -1
+// if there is none.
+func (l *Lexer) lastBreak(s string) (int, int) {
+	if !l.uniBreaks {
+		return strings.LastIndexByte(s, '\n'), 1
+	}
+	for i := len(s); i > 0; {
+		r, w := utf8.DecodeLastRuneInString(s[:i])
+		i -= w
+		if l.isBreak(r) {
+			return i, w
+		}
+	}
+	return -1, 0
 }
 
-func (l *Lexer) checkLines() {
-	val := l.Current()
-	l.line += bytes.Count([]byte(val), lineSep)
+// countBreaks returns the number of line breaks in s.
+func (l *Lexer) countBreaks(s string) int {
+	if !l.uniBreaks {
+		return strings.Count(s, "\n")
+	}
+	n := 0
+	for _, r := range s {
+		if l.isBreak(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// trackColumn updates the column of the start to follow val.
+func (l *Lexer) trackColumn(val string) {
+	if i, w := l.lastBreak(val); i >= 0 {
+		l.col = 0
+		val = val[i+w:]
+	}
+	l.col += utf8.RuneCountInString(val)
+}
+
+// Column returns the column of the current position, counting runes from the
+// start of the line.
+func (l *Lexer) Column() int {
+	return l.columnAt(l.position)
+}
+
+// columnAt returns the column of offset, which must not be before the start
+// of the current value.
+func (l *Lexer) columnAt(offset int) int {
+	val := l.slice(l.start, offset)
+	if i, w := l.lastBreak(val); i >= 0 {
+		return utf8.RuneCountInString(val[i+w:]) + l.base()
+	}
+	return l.col + utf8.RuneCountInString(val) + l.base()
+}
+
+// LineOffsets returns a copy of the offsets of the line breaks passed so
+// far. The line following the break at LineOffsets()[n] is line n+2. For
+// lexers reading from an io.Reader only the breaks within the input still
+// held in memory are returned.
+func (l *Lexer) LineOffsets() []int {
+	return append([]int(nil), l.lines...)
 }
 
 // Next pulls the next rune from the Lexer and returns it, moving the position
-// forward in the source.
+// forward in the source. A configured terminator is returned as EOFRune and
+// not consumed. With strict UTF-8, invalid encoding is also returned as
+// EOFRune and an error is emitted once the states finish.
 func (l *Lexer) Next() rune {
+	r, _ := l.next()
+	return r
+}
+
+// next is Next also returning the width of the rune.
+func (l *Lexer) next() (rune, int) {
 	var r rune
 	var s int
-	str := l.source[l.position:]
-	if len(str) == 0 {
+	l.fill()
+	str := l.source[l.position-l.offset:]
+	if len(str) == 0 || l.maxLines > 0 && l.line > l.maxLines {
 		r, s = EOFRune, 0
 	} else {
 		r, s = utf8.DecodeRuneInString(str)
+		if r == l.terminator {
+			r, s = EOFRune, 0
+		} else if l.strictUTF8 && r == utf8.RuneError && s == 1 {
+			l.invalid, l.invalidAt = true, l.position
+			r, s = EOFRune, 0
+		}
+	}
+	if l.isBreak(r) {
+		l.line++
+		if n := len(l.lines); n == 0 || l.lines[n-1] < l.position {
+			l.lines = append(l.lines, l.position)
+		}
 	}
 	l.position += s
-	l.history.push(r)
+	l.history.push(r, s)
 
-	return r
+	return r, s
 }
 
 // Ignore clears the history stack and then sets the current beginning position
 // to the current position in the source which effectively ignores the section
-// of the source being analyzed.
+// of the source being analyzed. In trivia mode the ignored section is sent on
+// the trivia channel.
 func (l *Lexer) Ignore() {
-	l.history.clear()
-	l.checkLines()
-	l.start = l.position
+	if l.start < l.position {
+		switch {
+		case l.inlineTriv:
+			l.send(l.token(TriviaToken, l.Current()))
+		case l.trivia != nil:
+			select {
+			case l.trivia <- l.token(TriviaToken, l.Current()):
+			case <-l.quit:
+			}
+		}
+	}
+	l.advance()
+}
+
+// LastRune returns the rune most recently returned by Next, or EOFRune if
+// there is none since the last Emit or Ignore. Under WithRetainedHistory the
+// retained runes still count, so after an Emit it returns the last rune of
+// the emitted value.
+func (l *Lexer) LastRune() rune {
+	return l.history.peek()
 }
 
 // Peek performs a Next operation immediately followed by a Backup returning the
-// peeked rune.
+// peeked rune. Invalid UTF-8 is handled according to the PeekPolicy.
 func (l *Lexer) Peek() rune {
-	r := l.Next()
+	r, w := l.next()
 	l.Backup()
 
+	if r == utf8.RuneError && w == 1 {
+		switch l.peekPolicy {
+		case PeekSentinel:
+			return InvalidRune
+		case PeekError:
+			l.Error("invalid UTF-8 encoding at %d", l.position)
+			return EOFRune
+		}
+	}
 	return r
 }
 
+// NextN calls Next up to n times and returns the runes read. If EOF is
+// reached first it returns the runes before it and false. Unlike AcceptCount,
+// nothing is backed up.
+func (l *Lexer) NextN(n int) ([]rune, bool) {
+	out := make([]rune, 0, n)
+	for len(out) < n {
+		r := l.Next()
+		if r == EOFRune {
+			return out, false
+		}
+		out = append(out, r)
+	}
+	return out, true
+}
+
+// PeekN returns up to the next n runes without consuming them. Fewer are
+// returned if EOF is reached first.
+func (l *Lexer) PeekN(n int) []rune {
+	var out []rune
+	calls := 0
+	for len(out) < n {
+		r := l.Next()
+		calls++
+		if r == EOFRune {
+			break
+		}
+		out = append(out, r)
+	}
+	for ; calls > 0; calls-- {
+		l.Backup()
+	}
+	return out
+}
+
+// RemainingIsBlank reports whether only whitespace remains before EOF.
+// Nothing is consumed.
+func (l *Lexer) RemainingIsBlank() bool {
+	n := 0
+	defer func() {
+		for ; n > 0; n-- {
+			l.Backup()
+		}
+	}()
+	for {
+		r := l.Next()
+		n++
+		if r == EOFRune {
+			return true
+		}
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+}
+
+// PeekSignificant returns the next rune that is not whitespace or part of a
+// line comment, and its offset, without consuming anything. Comments are only
+// skipped when configured with WithLineComment.
+func (l *Lexer) PeekSignificant() (rune, int) {
+	n := 0
+	defer func() {
+		for ; n > 0; n-- {
+			l.Backup()
+		}
+	}()
+	for {
+		offset := l.position
+		if l.comment != "" && l.hasPrefix(l.comment) {
+			for r := l.Next(); r != '\n' && r != EOFRune; r = l.Next() {
+				n++
+			}
+			n++
+			continue
+		}
+		r := l.Next()
+		n++
+		if !unicode.IsSpace(r) {
+			return r, offset
+		}
+	}
+}
+
 // Backup will take the last rune read (if any) and history back. Backups can
 // occur more than once per call to Next but you can never history past the
-// last point a token was emitted.
+// last point a token was emitted, unless WithRetainedHistory is set, in which
+// case the start moves back with the position.
 func (l *Lexer) Backup() {
-	r := l.history.pop()
+	r, size := l.history.pop()
+	if l.isBreak(r) {
+		l.line--
+		if n := len(l.lines); n > 0 && l.lines[n-1] == l.position-size {
+			l.lines = l.lines[:n-1]
+		}
+	}
 	if r > EOFRune {
-		size := utf8.RuneLen(r)
 		l.position -= size
 		if l.position < l.start {
-			l.position = l.start
+			if l.retain > 0 {
+				l.retreat(r)
+			} else {
+				l.position = l.start
+			}
 		}
 	}
 }
 
+// retreat moves the start back to the position after backing up over r,
+// retained from before the start.
+func (l *Lexer) retreat(r rune) {
+	l.start = l.position
+	l.startLine = l.line
+	if l.isBreak(r) {
+		l.col = utf8.RuneCountInString(l.slice(l.lineStart(l.position), l.position))
+	} else {
+		l.col--
+	}
+}
+
+// Marker is a point in the input saved by Mark.
+type Marker struct {
+	start     int
+	position  int
+	line      int
+	startLine int
+	col       int
+	history   stack
+}
+
+// Mark saves the state of the lexer so that it may later be returned to
+// with Restore. For lexers reading from an io.Reader the input from the
+// earliest mark onwards is kept in memory until every mark is released.
+func (l *Lexer) Mark() Marker {
+	if l.marks == 0 || l.start < l.keepFrom {
+		l.keepFrom = l.start
+	}
+	l.marks++
+	return Marker{
+		start:     l.start,
+		position:  l.position,
+		line:      l.line,
+		startLine: l.startLine,
+		col:       l.col,
+		history:   l.history,
+	}
+}
+
+// Restore returns the lexer to the state saved by m, even if values have
+// been emitted since. Emitted tokens are not withdrawn.
+func (l *Lexer) Restore(m Marker) {
+	l.start = m.start
+	l.position = m.position
+	l.line = m.line
+	l.startLine = m.startLine
+	l.col = m.col
+	l.lines = l.lines[:sort.SearchInts(l.lines, m.position)]
+	l.history = m.history
+}
+
+// Release reports that m will no longer be restored. Once every mark has
+// been released, input kept for them by a lexer reading from an io.Reader
+// may be discarded.
+func (l *Lexer) Release(m Marker) {
+	if l.marks > 0 {
+		l.marks--
+	}
+}
+
+// RunesSince returns the runes consumed between the offset mark, such as
+// taken from Pos, and the position. For lexers reading from an io.Reader the
+// offset must not be before the start of the current value or an active
+// Mark.
+func (l *Lexer) RunesSince(mark int) []rune {
+	return []rune(l.slice(mark, l.position))
+}
+
 // Accept receives a string containing all acceptable strings and will continue
 // over each consecutive character in the source until a token not in the given
 // string is encountered. This should be used to quickly pull token parts.
@@ -180,42 +1066,701 @@ func (l *Lexer) AcceptRun(valid string) (n int) {
 	return n
 }
 
-// SkipWhitespace continues over all unicode whitespace.
-func (l *Lexer) SkipWhitespace() {
+// AcceptRunMaxBytes consumes a run of runes from the valid set totalling at
+// most maxBytes bytes, returning the number of runes consumed.
+func (l *Lexer) AcceptRunMaxBytes(valid string, maxBytes int) (n int) {
+	used := 0
 	for {
-		r := l.Next()
+		r, w := l.next()
+		if used+w > maxBytes || strings.IndexRune(valid, r) < 0 {
+			l.Backup()
+			return n
+		}
+		used += w
+		n++
+	}
+}
 
-		if !unicode.IsSpace(r) {
+// AcceptFunc consumes the next rune if it satisfies pred.
+func (l *Lexer) AcceptFunc(pred func(rune) bool) bool {
+	if pred(l.Next()) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRunFunc consumes a run of runes satisfying pred. The run always ends
+// at EOF, which is not passed to pred.
+func (l *Lexer) AcceptRunFunc(pred func(rune) bool) (n int) {
+	for r := l.Next(); r != EOFRune && pred(r); r = l.Next() {
+		n++
+	}
+	l.Backup()
+	return n
+}
+
+// AcceptRunVisit is AcceptRunFunc calling visit with each rune accepted.
+func (l *Lexer) AcceptRunVisit(pred func(rune) bool, visit func(rune)) (n int) {
+	for r := l.Next(); r != EOFRune && pred(r); r = l.Next() {
+		visit(r)
+		n++
+	}
+	l.Backup()
+	return n
+}
+
+// AcceptAnyFunc consumes the next rune if it satisfies any of the predicates.
+func (l *Lexer) AcceptAnyFunc(preds ...func(rune) bool) bool {
+	r := l.Next()
+	for _, pred := range preds {
+		if pred(r) {
+			return true
+		}
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptTwoPhase consumes a rune satisfying first followed by a run of runes
+// satisfying rest, returning the matched text. Nothing is consumed if the
+// first rune does not match. EOF is never passed to either predicate.
+func (l *Lexer) AcceptTwoPhase(first, rest func(rune) bool) (string, bool) {
+	from := l.position
+	if r := l.Next(); r == EOFRune || !first(r) {
+		l.Backup()
+		return "", false
+	}
+	for r := l.Next(); r != EOFRune && rest(r); r = l.Next() {
+	}
+	l.Backup()
+	return l.slice(from, l.position), true
+}
+
+// AcceptRunBounded consumes at least min and at most max runes from the valid
+// set. If fewer than min match nothing is consumed and false is returned.
+func (l *Lexer) AcceptRunBounded(valid string, min, max int) (int, bool) {
+	n := 0
+	for n < max && l.Accept(valid) {
+		n++
+	}
+	if n < min {
+		for ; n > 0; n-- {
 			l.Backup()
+		}
+		return 0, false
+	}
+	return n, true
+}
+
+// AcceptString consumes s if the upcoming input begins with it. Otherwise
+// nothing is consumed and false is returned.
+func (l *Lexer) AcceptString(s string) bool {
+	if !l.hasPrefix(s) {
+		return false
+	}
+	for range s {
+		l.Next()
+	}
+	return true
+}
+
+// AcceptStringFold is AcceptString ignoring case, using Unicode case folding.
+func (l *Lexer) AcceptStringFold(s string) bool {
+	if !l.hasPrefixFunc(s, equalFold) {
+		return false
+	}
+	for range s {
+		l.Next()
+	}
+	return true
+}
+
+// AcceptFold is Accept ignoring case, using Unicode case folding.
+func (l *Lexer) AcceptFold(valid string) bool {
+	r := l.Next()
+	for _, v := range valid {
+		if equalFold(r, v) {
+			return true
+		}
+	}
+	l.Backup()
+	return false
+}
+
+// equalFold reports whether a and b are equal under Unicode case folding.
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	if a < 0 || b < 0 {
+		return false
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptLongest consumes the longest of the candidates matching the upcoming
+// input, so that "..." is preferred to ".." and ".". Nothing is consumed if
+// none match.
+func (l *Lexer) AcceptLongest(candidates ...string) (string, bool) {
+	best, ok := "", false
+	for _, c := range candidates {
+		if (!ok || len(c) > len(best)) && l.hasPrefix(c) {
+			best, ok = c, true
+		}
+	}
+	for range best {
+		l.Next()
+	}
+	return best, ok
+}
+
+// hasPrefix reports whether the upcoming input begins with s, leaving the
+// position unchanged.
+func (l *Lexer) hasPrefix(s string) bool {
+	return l.hasPrefixFunc(s, func(a, b rune) bool { return a == b })
+}
+
+// hasPrefixFunc is hasPrefix comparing runes with eq.
+func (l *Lexer) hasPrefixFunc(s string, eq func(a, b rune) bool) bool {
+	n, matched := 0, true
+	for _, r := range s {
+		n++
+		if !eq(l.Next(), r) {
+			matched = false
 			break
 		}
+	}
+	for ; n > 0; n-- {
+		l.Backup()
+	}
+	return matched
+}
 
+// AcceptNumberWithSeparators consumes decimal digits which may be separated
+// by single sep runes, such as "1_000". A leading, trailing or repeated
+// separator is malformed, in which case nothing is consumed and false is
+// returned.
+func (l *Lexer) AcceptNumberWithSeparators(sep rune) (string, bool) {
+	from := l.position
+	n, digit := 0, false
+	for {
+		r := l.Next()
+		if r >= '0' && r <= '9' {
+			digit = true
+		} else if r == sep && digit {
+			digit = false
+		} else {
+			l.Backup()
+			break
+		}
+		n++
+	}
+	if !digit {
+		for ; n > 0; n-- {
+			l.Backup()
+		}
+		return "", false
+	}
+	return l.slice(from, l.position), true
+}
+
+// AcceptBaseNumber consumes a run of digits valid in the given base, between
+// 2 and 36, using 0-9 and a-z case-insensitively. It stops at the first rune
+// that is not a valid digit and returns false if there were none.
+func (l *Lexer) AcceptBaseNumber(base int) (string, bool) {
+	if base < 2 || base > 36 {
+		return "", false
+	}
+	from := l.position
+	for digitValue(l.Next()) < base {
+	}
+	l.Backup()
+	return l.slice(from, l.position), l.position > from
+}
+
+// digitValue returns the value of r as a base 36 digit, or 36 if it is not
+// one.
+func digitValue(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0')
+	case r >= 'a' && r <= 'z':
+		return int(r-'a') + 10
+	case r >= 'A' && r <= 'Z':
+		return int(r-'A') + 10
+	}
+	return 36
+}
+
+// AcceptExponent consumes an exponent such as "e10" or "E-3" following a
+// mantissa. If there is no exponent marker or no digits follow it, nothing is
+// consumed and false is returned.
+func (l *Lexer) AcceptExponent() (string, bool) {
+	from := l.position
+	if !l.Accept("eE") {
+		return "", false
+	}
+	signed := l.Accept("+-")
+	if l.AcceptRun("0123456789") == 0 {
+		if signed {
+			l.Backup()
+		}
+		l.Backup()
+		return "", false
+	}
+	return l.slice(from, l.position), true
+}
+
+// AcceptThrough consumes runes up to and including the first rune in delims,
+// returning that rune. If EOF is reached first false is returned and the
+// runes before EOF remain consumed.
+func (l *Lexer) AcceptThrough(delims string) (rune, bool) {
+	for {
+		r := l.Next()
 		if r == EOFRune {
-			l.Emit(EOFToken)
+			l.Backup()
+			return EOFRune, false
+		}
+		if strings.IndexRune(delims, r) >= 0 {
+			return r, true
+		}
+	}
+}
+
+// AcceptUntil consumes runes up to but not including the first rune in delims
+// or EOF, returning the number of runes consumed.
+func (l *Lexer) AcceptUntil(delims string) (n int) {
+	for {
+		r := l.Next()
+		if r == EOFRune || strings.IndexRune(delims, r) >= 0 {
+			l.Backup()
+			return n
+		}
+		n++
+	}
+}
+
+// AcceptCount consumes exactly n runes of any kind and returns them. If EOF is
+// reached before n runes are consumed, everything is backed up and false is
+// returned.
+func (l *Lexer) AcceptCount(n int) (string, bool) {
+	from := l.position
+	for i := 0; i < n; i++ {
+		if l.Next() == EOFRune {
+			for ; i >= 0; i-- {
+				l.Backup()
+			}
+			return "", false
+		}
+	}
+	return l.slice(from, l.position), true
+}
+
+// EmitIndent consumes the spaces and tabs at the current position and emits
+// them as a token of type t. The token value is the indentation itself so its
+// length is the indent width. The width in runes is returned. It is intended
+// to be called at the start of a line.
+func (l *Lexer) EmitIndent(t TokenType) int {
+	n := l.AcceptRun(" \t")
+	l.Emit(t)
+	return n
+}
+
+// AcceptLineContinuation consumes a backslash immediately followed by a
+// newline, returning true. The line count is advanced but no line break is
+// emitted. If not positioned at a continuation nothing is consumed.
+func (l *Lexer) AcceptLineContinuation() bool {
+	if l.Next() == '\\' {
+		if l.Next() == '\n' {
+			return true
+		}
+		l.Backup()
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptStatementEnd consumes a ';', or a line break while whitespace is
+// significant, and returns it. If neither is next nothing is consumed.
+func (l *Lexer) AcceptStatementEnd() (rune, bool) {
+	r := l.Next()
+	if r == ';' || l.isBreak(r) && l.wsSignif {
+		return r, true
+	}
+	l.Backup()
+	return EOFRune, false
+}
+
+// AcceptShebang consumes an interpreter line beginning with "#!" at the start
+// of the source, up to but excluding the newline, and returns the interpreter
+// and its arguments. Nothing is consumed if not at the start of the source.
+func (l *Lexer) AcceptShebang() (string, bool) {
+	if l.position != 0 {
+		return "", false
+	}
+	if l.Next() != '#' {
+		l.Backup()
+		return "", false
+	}
+	if l.Next() != '!' {
+		l.Backup()
+		l.Backup()
+		return "", false
+	}
+	for r := l.Next(); r != '\n' && r != EOFRune; r = l.Next() {
+	}
+	l.Backup()
+	return strings.TrimSpace(l.slice(2, l.position)), true
+}
+
+// IsKeyword reports whether the current value is a registered keyword.
+func (l *Lexer) IsKeyword() bool {
+	_, ok := l.keyword(l.Current())
+	return ok
+}
+
+// EmitKeywordOr emits the current value as its keyword type if it is a
+// registered keyword, otherwise as type t.
+func (l *Lexer) EmitKeywordOr(t TokenType) {
+	if kt, ok := l.keyword(l.Current()); ok {
+		t = kt
+	}
+	l.Emit(t)
+}
+
+func (l *Lexer) keyword(s string) (TokenType, bool) {
+	if l.foldKeys {
+		s = strings.ToLower(s)
+	}
+	t, ok := l.keywords[s]
+	return t, ok
+}
+
+// SkipWhitespace continues over all unicode whitespace. When whitespace is
+// significant the whitespace is instead emitted as a WhitespaceToken, and
+// any value pending before it is dropped. It stops at EOF without emitting
+// anything, leaving the end of the input to the states.
+func (l *Lexer) SkipWhitespace() {
+	from := l.position
+	n := 0
+	for {
+		r := l.Next()
+
+		if !unicode.IsSpace(r) {
+			l.Backup()
 			break
 		}
+
+		n++
+	}
+	if l.wsSignif && n > 0 {
+		l.emitWhitespace(from)
+	}
+}
+
+// emitWhitespace emits the whitespace from offset from to the position.
+func (l *Lexer) emitWhitespace(from int) {
+	l.deliver(l.tokenAt(WhitespaceToken, l.slice(from, l.position), from, l.position))
+	l.advance()
+}
+
+// SkipLineWhitespace is SkipWhitespace stopping before any line break, so
+// that the line break may be handled by the states.
+func (l *Lexer) SkipLineWhitespace() {
+	from := l.position
+	n := 0
+	for r := l.Next(); !l.isBreak(r) && unicode.IsSpace(r); r = l.Next() {
+		n++
+	}
+	l.Backup()
+	if l.wsSignif && n > 0 {
+		l.emitWhitespace(from)
 	}
 }
 
+// SetWhitespaceSignificant sets whether SkipWhitespace emits whitespace as
+// tokens rather than skipping it. It may be changed by state functions as
+// the context changes.
+func (l *Lexer) SetWhitespaceSignificant(on bool) {
+	l.wsSignif = on
+}
+
+// OptionalWhitespace consumes any unicode whitespace and returns the number of
+// runes consumed. Unlike SkipWhitespace it never emits and the whitespace
+// remains part of the current value until Ignore is called.
+func (l *Lexer) OptionalWhitespace() (n int) {
+	for unicode.IsSpace(l.Next()) {
+		n++
+	}
+	l.Backup()
+	return n
+}
+
 // Tokens returns the a token channel.
 func (l *Lexer) Tokens() <-chan Token {
 	return l.tokens
 }
 
+// Trivia returns the channel of ignored input when the lexer was created
+// with WithTrivia, otherwise nil. When running asynchronously both Tokens and
+// Trivia must be drained concurrently.
+func (l *Lexer) Trivia() <-chan Token {
+	return l.trivia
+}
+
+// Workers starts n goroutines competing to receive tokens, each calling
+// handler for the tokens it receives, and waits for them to finish. The lexer
+// must already have been started.
+func (l *Lexer) Workers(n int, handler func(Token)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for tok := range l.tokens {
+				handler(tok)
+			}
+		}()
+	}
+	wg.Wait()
+	if tok, done := l.end(); !done {
+		handler(*tok)
+	}
+}
+
+// ParallelLex splits the source into up to n chunks, lexes them concurrently
+// and returns all the tokens in order. Chunks only end at offsets accepted by
+// the WithChunkBoundary predicate, by default the start of a line, and each
+// is lexed from the start state with the lexer's options. Positions are
+// relative to the full source. Only the last chunk ends with an EOFToken. The
+// source must be a string.
+func (l *Lexer) ParallelLex(n int) []Token {
+	boundary := l.boundary
+	if boundary == nil {
+		boundary = func(src string, i int) bool { return src[i-1] == '\n' }
+	}
+	var ends []int
+	from := l.origin
+	for i := 1; i <= n && from < len(l.source); i++ {
+		end := l.origin + (len(l.source)-l.origin)*i/n
+		if end <= from {
+			continue
+		}
+		for end < len(l.source) && !boundary(l.source, end) {
+			end++
+		}
+		ends = append(ends, end)
+		from = end
+	}
+
+	results := make([][]Token, len(ends))
+	var wg sync.WaitGroup
+	wg.Add(len(ends))
+	from = l.origin
+	for i, end := range ends {
+		go func(i, from, end int) {
+			defer wg.Done()
+			var s SliceEmitter
+			opts := append(l.opts[:len(l.opts):len(l.opts)], WithEmitter(&s))
+			if i < len(ends)-1 {
+				opts = append(opts, WithEndMode(EndClose))
+			}
+			NewSub(l.source, from, end, l.startState, opts...).StartSync()
+			results[i] = s.Tokens
+		}(i, from, end)
+		from = end
+	}
+	wg.Wait()
+
+	var out []Token
+	for _, toks := range results {
+		out = append(out, toks...)
+	}
+	return out
+}
+
+// Buffered returns the number of tokens waiting to be consumed.
+func (l *Lexer) Buffered() int {
+	return len(l.tokens)
+}
+
 // NextToken returns the next token from the lexer and done
 func (l *Lexer) NextToken() (*Token, bool) {
-	if tok, ok := <-l.tokens; ok {
-		return &tok, false
+	var tok *Token
+	done := false
+	if len(l.lookahead) > 0 {
+		t := l.lookahead[0]
+		l.lookahead = l.lookahead[1:]
+		tok = &t
+	} else if t, ok := <-l.tokens; ok {
+		tok = &t
+	} else {
+		tok, done = l.end()
+	}
+	l.last = tok
+	return tok, done
+}
+
+// Err returns an error describing the last token returned by NextToken if it
+// was an error token, otherwise nil.
+func (l *Lexer) Err() error {
+	if l.last == nil || !l.last.IsError() {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", l.last.Start, l.last.Value)
+}
+
+// end returns the result of NextToken once the tokens channel is closed.
+// A final token left by the lexer, the EOFToken under EndToken or an emit
+// timeout error, is returned once before reporting done.
+func (l *Lexer) end() (*Token, bool) {
+	if tok := l.final; tok != nil {
+		l.final = nil
+		return tok, false
 	}
 	return nil, true
 }
 
-func (l *Lexer) Error(format string, args ...interface{}) StateFunc {
-	l.tokens <- Token{
-		Type:     ErrorToken,
-		Value:    fmt.Sprintf(format, args...),
-		Position: l.position,
-		Line:     l.line,
+// receive returns the next token from the channel, and then any final token
+// from end, or false once there are none left.
+func (l *Lexer) receive() (Token, bool) {
+	if tok, ok := <-l.tokens; ok {
+		return tok, true
 	}
+	if tok, done := l.end(); !done {
+		return *tok, true
+	}
+	return Token{}, false
+}
+
+// PeekTokenValue returns the value of the next token without consuming it, or
+// false if there are no more tokens.
+func (l *Lexer) PeekTokenValue() (string, bool) {
+	toks := l.PeekTokens(1)
+	if len(toks) == 0 {
+		return "", false
+	}
+	return toks[0].Text(), true
+}
+
+// PeekTokens returns up to the next k tokens without consuming them. Fewer
+// are returned if the lexer finishes first.
+func (l *Lexer) PeekTokens(k int) []Token {
+	for len(l.lookahead) < k {
+		tok, ok := l.receive()
+		if !ok {
+			break
+		}
+		l.lookahead = append(l.lookahead, tok)
+	}
+	if k > len(l.lookahead) {
+		k = len(l.lookahead)
+	}
+	out := make([]Token, k)
+	copy(out, l.lookahead)
+	return out
+}
+
+// ScanAllSeparated runs the lexer to completion and returns the error tokens
+// separately from all others. It is useful when state functions continue
+// after reporting errors.
+func (l *Lexer) ScanAllSeparated() (tokens []Token, errs []Token) {
+	l.Start()
+	for tok, ok := l.receive(); ok; tok, ok = l.receive() {
+		if tok.Type == ErrorToken {
+			errs = append(errs, tok)
+		} else {
+			tokens = append(tokens, tok)
+		}
+	}
+	return tokens, errs
+}
+
+// Histogram runs the lexer to completion and returns the number of tokens of
+// each type and with each value.
+func (l *Lexer) Histogram() (map[TokenType]int, map[string]int) {
+	types := make(map[TokenType]int)
+	values := make(map[string]int)
+	l.Start()
+	for tok, ok := l.receive(); ok; tok, ok = l.receive() {
+		types[tok.Type]++
+		values[tok.Text()]++
+	}
+	return types, values
+}
+
+// All runs the lexer to completion and returns all the tokens in order,
+// including any error tokens and, unless the end mode is EndClose, the
+// trailing EOFToken. A configured Emitter still receives each token.
+func (l *Lexer) All() []Token {
+	var s SliceEmitter
+	prev := l.emitter
+	defer func() { l.emitter = prev }()
+	l.emitter = EmitterFunc(func(tok Token) {
+		s.Emit(tok)
+		if prev != nil {
+			prev.Emit(tok)
+		}
+	})
+	l.StartSync()
+	return s.Tokens
+}
+
+// ScanAllWithTrivia runs the lexer to completion and returns all tokens,
+// including ignored input as TriviaTokens, in source order. Concatenating
+// their values reproduces the source provided the state functions emit or
+// ignore everything they consume. Any configured Emitter is bypassed for
+// this run only.
+func (l *Lexer) ScanAllWithTrivia() []Token {
+	var s SliceEmitter
+	prev, inline := l.emitter, l.inlineTriv
+	defer func() { l.emitter, l.inlineTriv = prev, inline }()
+	l.emitter = &s
+	l.inlineTriv = true
+	l.StartSync()
+	return s.Tokens
+}
+
+// RelexErrorRegion lexes the source from the start of errTok to the end
+// using the fallback state and the lexer's options, and returns the tokens.
+// Positions are relative to the full source.
+func (l *Lexer) RelexErrorRegion(errTok Token, fallback StateFunc) []Token {
+	var s SliceEmitter
+	opts := append(l.opts[:len(l.opts):len(l.opts)], WithEmitter(&s))
+	sub := NewSub(l.source, errTok.Start.Offset, len(l.source), fallback, opts...)
+	sub.StartSync()
+	return s.Tokens
+}
+
+// PushState saves ret to be resumed by PopState and returns next. If the
+// maximum depth has been reached an error is emitted and nil returned.
+func (l *Lexer) PushState(ret, next StateFunc) StateFunc {
+	if len(l.states) >= l.maxDepth {
+		return l.Error("maximum state depth %d exceeded", l.maxDepth)
+	}
+	l.states = append(l.states, ret)
+	return next
+}
+
+// PopState removes and returns the most recently pushed state, or nil if
+// there is none.
+func (l *Lexer) PopState() StateFunc {
+	n := len(l.states)
+	if n == 0 {
+		return nil
+	}
+	s := l.states[n-1]
+	l.states = l.states[:n-1]
+	return s
+}
+
+func (l *Lexer) Error(format string, args ...interface{}) StateFunc {
+	l.send(l.token(ErrorToken, fmt.Sprintf(format, args...)))
 	return nil
 }
@@ -1,8 +1,15 @@
 package lexer
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -176,6 +183,26 @@ func TestBackup(t *testing.T) {
 	}
 }
 
+func TestBackupRetainedHistory(t *testing.T) {
+	var s SliceEmitter
+	l := New("abc\ndef", nil, WithEmitter(&s), WithRetainedHistory(2))
+	l.AcceptCount(5)
+	l.Emit(IdentToken)
+	l.Backup()
+	l.Backup()
+	if p := l.Pos(); p.Offset != 3 || p.Line != 1 || p.Column != 4 {
+		t.Fatalf("Expected 1:4 at offset 3 but got %s at %d", p, p.Offset)
+	}
+	l.Backup()
+	if p := l.Pos(); p.Offset != 3 {
+		t.Fatalf("Expected to stop after 2 runes but got offset %d", p.Offset)
+	}
+	l.AcceptCount(3)
+	if l.Current() != "\nde" {
+		t.Fatalf("Expected %q but got %q", "\nde", l.Current())
+	}
+}
+
 func TestWhitespace(t *testing.T) {
 	l := New("    1", NumberState)
 	l.StartSync()
@@ -191,6 +218,18 @@ func TestWhitespace(t *testing.T) {
 	}
 }
 
+func TestSkipWhitespaceAtEOF(t *testing.T) {
+	var s SliceEmitter
+	l := New("   ", nil, WithEmitter(&s))
+	l.SkipWhitespace()
+	if len(s.Tokens) != 0 {
+		t.Fatalf("Expected no tokens but got %v", s.Tokens)
+	}
+	if l.Current() != "   " || l.Peek() != EOFRune {
+		t.Fatalf("Expected to stop at EOF but got %q", l.Current())
+	}
+}
+
 func TestMultipleTokens(t *testing.T) {
 	cases := []struct {
 		tokType TokenType
@@ -232,6 +271,36 @@ func TestMultipleTokens(t *testing.T) {
 	}
 }
 
+func TestAll(t *testing.T) {
+	got := Signatures(New("123.hello  675.world", NumberState).All())
+	expected := []string{"0:123", "1:.", "2:hello", "0:675", "1:.", "2:world"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v but got %v", expected, got)
+	}
+
+	toks := New("notaspace", WhitespaceState).All()
+	if len(toks) != 1 || toks[0].Type != ErrorToken {
+		t.Fatalf("Expected an error token but got %v", toks)
+	}
+
+	for _, mode := range []EndMode{EndToken, EndBoth} {
+		toks = New("1", commentState, WithEndMode(mode)).All()
+		if len(toks) != 2 || toks[1].Type != EOFToken || toks[1].Value != "" {
+			t.Fatalf("%d: expected a trailing EOF token but got %v", mode, toks)
+		}
+	}
+
+	var s SliceEmitter
+	l := New("1 2", commentState, WithEmitter(&s))
+	toks = l.All()
+	if len(toks) != 2 || !reflect.DeepEqual(s.Tokens, toks) {
+		t.Fatalf("Expected the emitter to receive %v but got %v", toks, s.Tokens)
+	}
+	if l.emitter != &s {
+		t.Fatal("Expected the emitter to be restored")
+	}
+}
+
 func TestError(t *testing.T) {
 	l := New("notaspace", WhitespaceState)
 	l.StartSync()
@@ -244,4 +313,2131 @@ func TestError(t *testing.T) {
 	if tok.Type != ErrorToken {
 		t.Fatalf("Expected error token but got %v", *tok)
 	}
+
+	if !tok.IsError() || tok.IsEOF() {
+		t.Fatalf("Expected IsError but got %v", *tok)
+	}
+	if err := l.Err(); err == nil || err.Error() != "1:1: unexpected token 'n'" {
+		t.Fatalf("Expected error at 1:1 but got %v", err)
+	}
+	if _, done := l.NextToken(); !done || l.Err() != nil {
+		t.Fatalf("Expected done without error but got %v", l.Err())
+	}
+}
+
+var startPaths = []struct {
+	name  string
+	start func(*Lexer)
+}{
+	{"sync", (*Lexer).StartSync},
+	{"async", (*Lexer).Start},
+}
+
+func collect(l *Lexer) []Token {
+	var out []Token
+	for {
+		tok, done := l.NextToken()
+		if done {
+			return out
+		}
+		out = append(out, *tok)
+	}
+}
+
+func TestStartPathsConsistent(t *testing.T) {
+	cases := []struct {
+		src   string
+		state StateFunc
+	}{
+		{"123", NumberState},
+		{"123.hello  675.world", NumberState},
+		{"123\n456\n789", NewlineState},
+		{"notaspace", WhitespaceState},
+	}
+
+	for _, c := range cases {
+		var expected []Token
+		for i, p := range startPaths {
+			l := New(c.src, c.state)
+			p.start(l)
+			toks := collect(l)
+			if i == 0 {
+				expected = toks
+				continue
+			}
+			if !reflect.DeepEqual(expected, toks) {
+				t.Fatalf("%q: %s path got %v, expected %v", c.src, p.name, toks, expected)
+			}
+		}
+	}
+}
+
+func TestMarkRestore(t *testing.T) {
+	var s SliceEmitter
+	l := New("ab\ncd ef", nil, WithEmitter(&s))
+	l.Next()
+	m := l.Mark()
+	for i := 0; i < 4; i++ {
+		l.Next()
+	}
+	l.Emit(IdentToken)
+	l.Next()
+
+	l.Restore(m)
+	if l.Current() != "a" {
+		t.Fatalf("Expected %q but got %q", "a", l.Current())
+	}
+	if r := l.Next(); r != 'b' {
+		t.Fatalf("Expected 'b' but got %q", r)
+	}
+	l.Backup()
+	l.Backup()
+	if l.Current() != "" {
+		t.Fatalf("Expected history restored but got %q", l.Current())
+	}
+	if p := l.Pos(); p.Line != 1 || len(l.LineOffsets()) != 0 {
+		t.Fatalf("Expected line 1 but got %s with %v", p, l.LineOffsets())
+	}
+	if len(s.Tokens) != 1 {
+		t.Fatalf("Expected emitted token to remain but got %v", s.Tokens)
+	}
+}
+
+func TestRunesSince(t *testing.T) {
+	l := New(`x\u00e9!`, nil)
+	l.Next()
+	mark := l.Pos().Offset
+	l.AcceptCount(6)
+	if got := string(l.RunesSince(mark)); got != `\u00e9` {
+		t.Fatalf("Expected %q but got %q", `\u00e9`, got)
+	}
+	if got := l.RunesSince(l.Pos().Offset); len(got) != 0 {
+		t.Fatalf("Expected no runes but got %q", got)
+	}
+
+	l = New("añb", nil)
+	l.AcceptCount(2)
+	if got := l.RunesSince(0); !reflect.DeepEqual(got, []rune{'a', 'ñ'}) {
+		t.Fatalf("Expected [a ñ] but got %q", got)
+	}
+}
+
+func TestAcceptCount(t *testing.T) {
+	cases := []struct {
+		src  string
+		n    int
+		val  string
+		ok   bool
+		next rune
+	}{
+		{"abcdef", 3, "abc", true, 'd'},
+		{"ab", 3, "", false, 'a'},
+		{"abc", 0, "", true, 'a'},
+		{"héllo", 2, "hé", true, 'l'},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		val, ok := l.AcceptCount(c.n)
+		if ok != c.ok {
+			t.Fatalf("%q: expected ok %t but got %t", c.src, c.ok, ok)
+		}
+		if val != c.val {
+			t.Fatalf("%q: expected %q but got %q", c.src, c.val, val)
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+}
+
+func TestEmitIndent(t *testing.T) {
+	var widths []int
+	var lineState StateFunc
+	lineState = func(l *Lexer) StateFunc {
+		widths = append(widths, l.EmitIndent(OpToken))
+		l.AcceptRun("abcdefghijklmnopqrstuvwxyz")
+		l.Emit(IdentToken)
+		if l.Next() == EOFRune {
+			return nil
+		}
+		l.Ignore()
+		return lineState
+	}
+
+	l := New("a\n  b\n\tc\n    d", lineState)
+	l.Start()
+
+	expected := []string{"", "  ", "\t", "    "}
+	var indents []string
+	for tok := range l.Tokens() {
+		if tok.Type == OpToken {
+			indents = append(indents, tok.Value)
+		}
+	}
+	if !reflect.DeepEqual(indents, expected) {
+		t.Fatalf("Expected %q but got %q", expected, indents)
+	}
+	if !reflect.DeepEqual(widths, []int{0, 2, 1, 4}) {
+		t.Fatalf("Expected widths [0 2 1 4] but got %v", widths)
+	}
+}
+
+func TestIsKeyword(t *testing.T) {
+	keywords := map[string]TokenType{"func": IdentToken, "var": IdentToken}
+	cases := []struct {
+		src      string
+		expected bool
+	}{
+		{"func", true},
+		{"var", true},
+		{"function", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil, WithKeywords(keywords))
+		l.AcceptRun("abcdefghijklmnopqrstuvwxyz")
+		if l.IsKeyword() != c.expected {
+			t.Fatalf("%q: expected %t but got %t", c.src, c.expected, l.IsKeyword())
+		}
+	}
+}
+
+func TestAcceptLineContinuation(t *testing.T) {
+	l := New("ab\\\ncd\ne", nil)
+	l.AcceptRun("abcd")
+	if !l.AcceptLineContinuation() {
+		t.Fatal("Expected a line continuation")
+	}
+	l.AcceptRun("abcd")
+	l.Ignore()
+	if l.line != 2 {
+		t.Fatalf("Expected line 2 but got %d", l.line)
+	}
+
+	l = New("\\a", nil)
+	if l.AcceptLineContinuation() {
+		t.Fatal("Expected no line continuation")
+	}
+	if r := l.Next(); r != '\\' {
+		t.Fatalf("Expected %q but got %q", '\\', r)
+	}
+}
+
+func TestBuffered(t *testing.T) {
+	l := New("123456", func(l *Lexer) StateFunc {
+		for _, ok := l.AcceptCount(2); ok; _, ok = l.AcceptCount(2) {
+			l.Emit(NumberToken)
+		}
+		return nil
+	})
+	l.StartSync()
+	if l.Buffered() != 3 {
+		t.Fatalf("Expected 3 buffered but got %d", l.Buffered())
+	}
+	l.NextToken()
+	if l.Buffered() != 2 {
+		t.Fatalf("Expected 2 buffered but got %d", l.Buffered())
+	}
+}
+
+func TestReclassifyAndEmit(t *testing.T) {
+	l := New("abc", func(l *Lexer) StateFunc {
+		if l.ReclassifyAndEmit(NumberToken) {
+			l.Error("expected empty buffer to be rejected")
+		}
+		l.AcceptRun("abc")
+		l.ReclassifyAndEmit(IdentToken)
+		return nil
+	})
+	l.StartSync()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Fatal("Expected a token but lexer finished")
+	}
+	if tok.Type != IdentToken || tok.Value != "abc" {
+		t.Fatalf("Expected ident abc but got %v", *tok)
+	}
+	if _, done = l.NextToken(); !done {
+		t.Fatal("Expected done but it wasn't.")
+	}
+}
+
+func commentState(l *Lexer) StateFunc {
+	for {
+		switch r := l.Next(); {
+		case r == EOFRune:
+			return nil
+		case r == '#':
+			for r = l.Peek(); r != '\n' && r != EOFRune; r = l.Peek() {
+				l.Next()
+			}
+			l.Ignore()
+		case r >= '0' && r <= '9':
+			l.AcceptRun("0123456789")
+			l.Emit(NumberToken)
+		default:
+			l.AcceptRun(" \t\n")
+			l.Ignore()
+		}
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	l := New("1 2 # two\n3", commentState, WithTrivia())
+	l.StartSync()
+
+	var values, trivia []string
+	for tok := range l.Tokens() {
+		values = append(values, tok.Value)
+	}
+	for tok := range l.Trivia() {
+		if tok.Type != TriviaToken {
+			t.Fatalf("Expected trivia token but got %v", tok)
+		}
+		trivia = append(trivia, tok.Value)
+	}
+
+	if !reflect.DeepEqual(values, []string{"1", "2", "3"}) {
+		t.Fatalf("Expected [1 2 3] but got %q", values)
+	}
+	expected := []string{" ", " ", "# two", "\n"}
+	if !reflect.DeepEqual(trivia, expected) {
+		t.Fatalf("Expected %q but got %q", expected, trivia)
+	}
+}
+
+func TestAcceptRunBounded(t *testing.T) {
+	const hex = "0123456789abcdef"
+	cases := []struct {
+		src  string
+		n    int
+		ok   bool
+		next rune
+	}{
+		{"ab", 2, true, EOFRune},
+		{"abc!", 3, true, '!'},
+		{"a!", 0, false, 'a'},
+		{"abcdef", 4, true, 'e'},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		n, ok := l.AcceptRunBounded(hex, 2, 4)
+		if ok != c.ok {
+			t.Fatalf("%q: expected ok %t but got %t", c.src, c.ok, ok)
+		}
+		if n != c.n {
+			t.Fatalf("%q: expected %d but got %d", c.src, c.n, n)
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	a := New("123.hello 675.world", NumberState)
+	a.StartSync()
+	b := New("123.hello  675.world", NumberState)
+	b.StartSync()
+
+	ta, tb := collect(a), collect(b)
+	if reflect.DeepEqual(ta, tb) {
+		t.Fatal("Expected positions to differ")
+	}
+	sa, sb := Signatures(ta), Signatures(tb)
+	if !reflect.DeepEqual(sa, sb) {
+		t.Fatalf("Expected %q but got %q", sa, sb)
+	}
+	if sa[2] != "2:hello" {
+		t.Fatalf("Expected %q but got %q", "2:hello", sa[2])
+	}
+}
+
+func TestNewSub(t *testing.T) {
+	full := "abc\n123.hello\nxyz"
+	l := NewSub(full, 4, 13, NumberState)
+	l.StartSync()
+
+	cases := []struct {
+		val      string
+		position int
+	}{
+		{"123", 4},
+		{".", 7},
+		{"hello", 8},
+	}
+	for _, c := range cases {
+		tok, done := l.NextToken()
+		if done {
+			t.Fatal("Expected more tokens but lexer finished")
+		}
+		if tok.Value != c.val {
+			t.Fatalf("Expected %q but got %q", c.val, tok.Value)
+		}
+		if tok.Position != c.position {
+			t.Fatalf("Expected position %d but got %d", c.position, tok.Position)
+		}
+		if full[tok.Position:tok.Position+len(tok.Value)] != c.val {
+			t.Fatalf("Expected %q at position %d in the full document", c.val, tok.Position)
+		}
+		if tok.Line != 2 {
+			t.Fatalf("Expected line 2 but got %d", tok.Line)
+		}
+	}
+}
+
+func TestOptionalWhitespace(t *testing.T) {
+	l := New(" \t\n1", nil)
+	if n := l.OptionalWhitespace(); n != 3 {
+		t.Fatalf("Expected 3 but got %d", n)
+	}
+	if l.Current() != " \t\n" {
+		t.Fatalf("Expected whitespace to remain current but got %q", l.Current())
+	}
+	l.Ignore()
+	if n := l.OptionalWhitespace(); n != 0 {
+		t.Fatalf("Expected 0 but got %d", n)
+	}
+	if r := l.Next(); r != '1' {
+		t.Fatalf("Expected %q but got %q", '1', r)
+	}
+}
+
+func TestFoldKeywords(t *testing.T) {
+	keywords := map[string]TokenType{"select": OpToken}
+	state := func(l *Lexer) StateFunc {
+		l.AcceptRun("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+		l.EmitKeywordOr(IdentToken)
+		return nil
+	}
+
+	l := New("SELECT", state, WithKeywords(keywords), WithFoldKeywords())
+	l.StartSync()
+	tok, _ := l.NextToken()
+	if tok.Type != OpToken {
+		t.Fatalf("Expected keyword token but got %v", *tok)
+	}
+	if tok.Value != "SELECT" {
+		t.Fatalf("Expected %q but got %q", "SELECT", tok.Value)
+	}
+
+	l = New("SELECT", state, WithKeywords(keywords))
+	l.StartSync()
+	tok, _ = l.NextToken()
+	if tok.Type != IdentToken {
+		t.Fatalf("Expected ident token but got %v", *tok)
+	}
+}
+
+func TestAcceptAnyFunc(t *testing.T) {
+	underscore := func(r rune) bool { return r == '_' }
+	l := New("_aé1", nil)
+	n := 0
+	for l.AcceptAnyFunc(unicode.IsLetter, underscore) {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 but got %d", n)
+	}
+	if l.Current() != "_aé" {
+		t.Fatalf("Expected %q but got %q", "_aé", l.Current())
+	}
+	if r := l.Next(); r != '1' {
+		t.Fatalf("Expected %q but got %q", '1', r)
+	}
+}
+
+func TestAcceptRunMaxBytes(t *testing.T) {
+	cases := []struct {
+		src      string
+		maxBytes int
+		n        int
+		val      string
+	}{
+		{"aaaa", 3, 3, "aaa"},
+		{"aéa", 3, 2, "aé"},
+		{"aéa", 2, 1, "a"},
+		{"éé", 5, 2, "éé"},
+		{"aab", 10, 2, "aa"},
+		{"a", 0, 0, ""},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		n := l.AcceptRunMaxBytes("aé", c.maxBytes)
+		if n != c.n || l.Current() != c.val {
+			t.Fatalf("%q/%d: expected %d runes %q but got %d runes %q", c.src, c.maxBytes, c.n, c.val, n, l.Current())
+		}
+	}
+}
+
+func TestAcceptFunc(t *testing.T) {
+	l := New("42abc", nil)
+	if n := l.AcceptRunFunc(unicode.IsDigit); n != 2 {
+		t.Fatalf("Expected 2 but got %d", n)
+	}
+	if l.Current() != "42" {
+		t.Fatalf("Expected %q but got %q", "42", l.Current())
+	}
+	if l.AcceptFunc(unicode.IsDigit) {
+		t.Fatal("Expected 'a' not to be accepted")
+	}
+	if !l.AcceptFunc(unicode.IsLetter) {
+		t.Fatal("Expected 'a' to be accepted")
+	}
+	if r := l.Next(); r != 'b' {
+		t.Fatalf("Expected %q but got %q", 'b', r)
+	}
+
+	l = New("abc", nil)
+	if n := l.AcceptRunFunc(func(r rune) bool { return r != '"' }); n != 3 {
+		t.Fatalf("Expected 3 but got %d", n)
+	}
+}
+
+func TestAcceptRunVisit(t *testing.T) {
+	var b strings.Builder
+	l := New("HeLLo world", nil)
+	n := l.AcceptRunVisit(unicode.IsLetter, func(r rune) {
+		b.WriteRune(unicode.ToLower(r))
+	})
+	if n != 5 || b.String() != "hello" {
+		t.Fatalf("Expected 5 runes as hello but got %d as %q", n, b.String())
+	}
+	if r := l.Next(); r != ' ' {
+		t.Fatalf("Expected ' ' but got %q", r)
+	}
+
+	l = New("ab", nil)
+	n = l.AcceptRunVisit(func(r rune) bool { return r != '"' }, func(r rune) {
+		if r == EOFRune {
+			t.Fatal("Expected EOF not to be visited")
+		}
+	})
+	if n != 2 {
+		t.Fatalf("Expected 2 but got %d", n)
+	}
+}
+
+func TestLineOffsets(t *testing.T) {
+	src := "1\n22\n\n333\n4"
+	l := New(src, commentState)
+	l.StartSync()
+	collect(l)
+
+	expected := []int{1, 4, 5, 9}
+	if !reflect.DeepEqual(l.LineOffsets(), expected) {
+		t.Fatalf("Expected %v but got %v", expected, l.LineOffsets())
+	}
+	l.LineOffsets()[0] = 7
+	if !reflect.DeepEqual(l.LineOffsets(), expected) {
+		t.Fatalf("Expected a copy but got %v", l.LineOffsets())
+	}
+
+	l = New("a\nb", nil)
+	l.Next()
+	l.Peek()
+	if offsets := l.LineOffsets(); len(offsets) != 0 {
+		t.Fatalf("Expected no offsets before the newline is passed but got %v", offsets)
+	}
+	for _, o := range l.LineOffsets() {
+		if src[o] != '\n' {
+			t.Fatalf("Expected newline at %d but got %q", o, src[o])
+		}
+	}
+
+	l = NewSub(src, 5, len(src), commentState)
+	if !reflect.DeepEqual(l.LineOffsets(), []int{1, 4}) {
+		t.Fatalf("Expected [1 4] but got %v", l.LineOffsets())
+	}
+}
+
+func TestEmitOrEOF(t *testing.T) {
+	l := New("1abc", nil)
+	l.prepare()
+	l.Next()
+	if next := l.EmitOrEOF(NumberToken, NumberState); next == nil {
+		t.Fatal("Expected next state but got nil")
+	}
+	l.AcceptRun("abc")
+	if next := l.EmitOrEOF(IdentToken, NumberState); next != nil {
+		t.Fatal("Expected nil state at EOF")
+	}
+}
+
+func TestTerminator(t *testing.T) {
+	l := New("123.hello\x00675.world", NumberState, WithTerminator(0))
+	l.StartSync()
+
+	var values []string
+	for _, tok := range collect(l) {
+		values = append(values, tok.Value)
+	}
+	if !reflect.DeepEqual(values, []string{"123", ".", "hello"}) {
+		t.Fatalf("Expected [123 . hello] but got %q", values)
+	}
+	if l.Next() != EOFRune {
+		t.Fatal("Expected EOFRune at the terminator")
+	}
+	if l.Current() != "" {
+		t.Fatalf("Expected terminator not to be consumed but got %q", l.Current())
+	}
+}
+
+func TestScanAllSeparated(t *testing.T) {
+	l := New("1 x 2 y 3", func(l *Lexer) StateFunc {
+		for r := l.Next(); r != EOFRune; r = l.Next() {
+			switch {
+			case r >= '0' && r <= '9':
+				l.Emit(NumberToken)
+			case r == ' ':
+				l.Ignore()
+			default:
+				l.Error("unexpected %q", r)
+				l.Ignore()
+			}
+		}
+		return nil
+	})
+
+	tokens, errs := l.ScanAllSeparated()
+	if len(tokens) != 3 {
+		t.Fatalf("Expected 3 tokens but got %v", tokens)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %v", errs)
+	}
+	if errs[1].Value != `unexpected 'y'` {
+		t.Fatalf("Expected %q but got %q", `unexpected 'y'`, errs[1].Value)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	l := New("1 22 1 333 1 22", commentState)
+	types, values := l.Histogram()
+	if !reflect.DeepEqual(types, map[TokenType]int{NumberToken: 6}) {
+		t.Fatalf("Expected 6 numbers but got %v", types)
+	}
+	expected := map[string]int{"1": 3, "22": 2, "333": 1}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %v but got %v", expected, values)
+	}
+}
+
+func TestAcceptShebang(t *testing.T) {
+	l := New("#!/usr/bin/env python\nprint()", nil)
+	interp, ok := l.AcceptShebang()
+	if !ok {
+		t.Fatal("Expected a shebang")
+	}
+	if interp != "/usr/bin/env python" {
+		t.Fatalf("Expected %q but got %q", "/usr/bin/env python", interp)
+	}
+	if r := l.Next(); r != '\n' {
+		t.Fatalf("Expected newline but got %q", r)
+	}
+	if _, ok = l.AcceptShebang(); ok {
+		t.Fatal("Expected no shebang away from the start")
+	}
+
+	l = New("# comment\n", nil)
+	if _, ok = l.AcceptShebang(); ok {
+		t.Fatal("Expected no shebang")
+	}
+	if l.Current() != "" {
+		t.Fatalf("Expected nothing consumed but got %q", l.Current())
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	src := "1\n22\n333\n4444"
+	cases := []struct {
+		max      int
+		expected []string
+	}{
+		{1, []string{"1"}},
+		{2, []string{"1", "22"}},
+		{4, []string{"1", "22", "333", "4444"}},
+		{10, []string{"1", "22", "333", "4444"}},
+	}
+
+	for _, c := range cases {
+		l := New(src, commentState, WithMaxLines(c.max))
+		l.StartSync()
+		var values []string
+		for _, tok := range collect(l) {
+			values = append(values, tok.Value)
+		}
+		if !reflect.DeepEqual(values, c.expected) {
+			t.Fatalf("%d: expected %q but got %q", c.max, c.expected, values)
+		}
+	}
+}
+
+func TestLastRune(t *testing.T) {
+	l := New("abc", nil)
+	l.prepare()
+	if r := l.LastRune(); r != EOFRune {
+		t.Fatalf("Expected EOFRune but got %q", r)
+	}
+	l.Next()
+	l.Next()
+	if r := l.LastRune(); r != 'b' {
+		t.Fatalf("Expected %q but got %q", 'b', r)
+	}
+	l.Backup()
+	if r := l.LastRune(); r != 'a' {
+		t.Fatalf("Expected %q but got %q", 'a', r)
+	}
+	l.Emit(IdentToken)
+	if r := l.LastRune(); r != EOFRune {
+		t.Fatalf("Expected EOFRune after Emit but got %q", r)
+	}
+
+	l = New("abc", nil, WithEmitter(&SliceEmitter{}), WithRetainedHistory(2))
+	l.Next()
+	l.Next()
+	l.Emit(IdentToken)
+	if r := l.LastRune(); r != 'b' {
+		t.Fatalf("Expected the retained %q after Emit but got %q", 'b', r)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	var src strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&src, "%d ", i)
+	}
+	l := New(src.String(), commentState)
+	l.Start()
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	l.Workers(4, func(tok Token) {
+		mu.Lock()
+		seen[tok.Value]++
+		mu.Unlock()
+	})
+
+	if len(seen) != 1000 {
+		t.Fatalf("Expected 1000 distinct tokens but got %d", len(seen))
+	}
+	for v, n := range seen {
+		if n != 1 {
+			t.Fatalf("Expected %q to be handled once but was %d times", v, n)
+		}
+	}
+}
+
+func TestEmitIf(t *testing.T) {
+	// Numbers are only emitted when followed by a '.'
+	l := New("12.34", func(l *Lexer) StateFunc {
+		l.AcceptRun("0123456789")
+		l.EmitIf(l.Peek() == '.', NumberToken)
+		l.Next()
+		l.Ignore()
+		l.AcceptRun("0123456789")
+		if l.EmitIf(l.Peek() == '.', NumberToken) {
+			l.Error("expected no emit")
+		}
+		l.AcceptRun("0123456789")
+		l.Emit(IdentToken)
+		return nil
+	})
+	l.StartSync()
+
+	expected := []string{"0:12", "2:34"}
+	if s := Signatures(collect(l)); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected %q but got %q", expected, s)
+	}
+
+	l = New("ab\ncd\nef", func(l *Lexer) StateFunc {
+		l.AcceptRun("abcd\n")
+		l.EmitIf(false, IdentToken)
+		l.AcceptRun("ab\n")
+		l.Ignore()
+		l.AcceptRun("cd")
+		l.Emit(IdentToken)
+		return nil
+	})
+	l.StartSync()
+	tok, _ := l.NextToken()
+	if tok.Value != "cd" || tok.Start.String() != "2:1" {
+		t.Fatalf("Expected cd at 2:1 but got %q at %s", tok.Value, tok.Start)
+	}
+}
+
+func TestScanAllWithTrivia(t *testing.T) {
+	src := "1 2 # two\n  3\n"
+	l := New(src, commentState)
+	toks := l.ScanAllWithTrivia()
+
+	if s := Render(toks); s != src {
+		t.Fatalf("Expected %q but got %q", src, s)
+	}
+	if toks[1].Type != TriviaToken || toks[2].Type != NumberToken {
+		t.Fatalf("Expected trivia interleaved but got %v", toks)
+	}
+
+	var s SliceEmitter
+	l = New(src, commentState, WithEmitter(&s))
+	l.ScanAllWithTrivia()
+	if len(s.Tokens) != 0 {
+		t.Fatalf("Expected the emitter to be bypassed but got %v", s.Tokens)
+	}
+	l.Rewind()
+	l.StartSync()
+	if expected := []string{"0:1", "0:2", "0:3"}; !reflect.DeepEqual(Signatures(s.Tokens), expected) {
+		t.Fatalf("Expected %q without trivia but got %q", expected, Signatures(s.Tokens))
+	}
+}
+
+func TestRender(t *testing.T) {
+	src := "1 2 # two\n  3\n"
+	if s := Render(New(src, commentState).All()); s != "123" {
+		t.Fatalf("Expected %q but got %q", "123", s)
+	}
+	if s := Render(New(src, commentState).ScanAllWithTrivia()); s != src {
+		t.Fatalf("Expected %q but got %q", src, s)
+	}
+	if s := Render(nil); s != "" {
+		t.Fatalf("Expected empty string but got %q", s)
+	}
+}
+
+func TestAcceptString(t *testing.T) {
+	l := New("function", nil)
+	if !l.AcceptString("func") || l.Current() != "func" {
+		t.Fatalf("Expected to accept func but got %q", l.Current())
+	}
+	if r := l.Next(); r != 't' {
+		t.Fatalf("Expected 't' but got %q", r)
+	}
+
+	l = New("funny", nil)
+	if l.AcceptString("func") || l.Current() != "" {
+		t.Fatalf("Expected nothing consumed but got %q", l.Current())
+	}
+	if r := l.Next(); r != 'f' {
+		t.Fatalf("Expected 'f' but got %q", r)
+	}
+	l.Backup()
+	if l.Current() != "" {
+		t.Fatalf("Expected history restored but got %q", l.Current())
+	}
+}
+
+func TestAcceptFold(t *testing.T) {
+	l := New("select * FROM", nil)
+	if !l.AcceptStringFold("SELECT") || l.Current() != "select" {
+		t.Fatalf("Expected to accept select but got %q", l.Current())
+	}
+	l.Ignore()
+	if l.AcceptStringFold(" *x") || l.Current() != "" {
+		t.Fatalf("Expected nothing consumed but got %q", l.Current())
+	}
+	l.AcceptCount(3)
+	l.Ignore()
+	if !l.AcceptFold("f") || !l.AcceptFold("xR") || l.AcceptFold("xyz") {
+		t.Fatal("Expected to accept F and R only")
+	}
+	if l.Current() != "FR" {
+		t.Fatalf("Expected FR but got %q", l.Current())
+	}
+
+	l = New("STRASSE", nil)
+	if !l.AcceptStringFold("strasse") {
+		t.Fatal("Expected to accept STRASSE")
+	}
+	l = New("K", nil)
+	if !l.AcceptFold("k") {
+		t.Fatal("Expected the Kelvin sign to fold to k")
+	}
+}
+
+func TestAcceptLongest(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+		ok       bool
+		next     rune
+	}{
+		{".a", ".", true, 'a'},
+		{"..a", "..", true, 'a'},
+		{"...a", "...", true, 'a'},
+		{"....", "...", true, '.'},
+		{"a", "", false, 'a'},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		val, ok := l.AcceptLongest(".", "...", "..")
+		if ok != c.ok || val != c.expected {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.expected, c.ok, val, ok)
+		}
+		if l.Current() != c.expected {
+			t.Fatalf("%q: expected %q consumed but got %q", c.src, c.expected, l.Current())
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+}
+
+func TestEmitMarker(t *testing.T) {
+	l := New("12;34", func(l *Lexer) StateFunc {
+		l.AcceptRun("0123456789")
+		l.EmitMarker(OpToken)
+		l.Emit(NumberToken)
+		l.Next()
+		l.Ignore()
+		l.AcceptRun("0123456789")
+		l.Emit(NumberToken)
+		return nil
+	})
+	l.Start()
+	toks := collect(l)
+
+	expected := []string{"1:", "0:12", "0:34"}
+	if s := Signatures(toks); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected %q but got %q", expected, s)
+	}
+	if toks[0].Position != 2 || toks[0].Line != 1 {
+		t.Fatalf("Expected marker at 2 on line 1 but got %d on %d", toks[0].Position, toks[0].Line)
+	}
+	if h := l.TokenHistory(3); len(h) != 3 || h[0].Type != OpToken {
+		t.Fatalf("Expected the marker in the history but got %v", h)
+	}
+
+	l = New("1", func(l *Lexer) StateFunc {
+		l.EmitMarker(TokenType(999))
+		return nil
+	}, WithStrictTokenTypes())
+	l.StartSync()
+	if tok, _ := l.NextToken(); tok.Type != ErrorToken {
+		t.Fatalf("Expected an error for the unregistered marker but got %v", *tok)
+	}
+}
+
+func TestRelexErrorRegion(t *testing.T) {
+	l := New("123abc", func(l *Lexer) StateFunc {
+		l.AcceptRun("0123456789")
+		l.Emit(NumberToken)
+		if l.Peek() != EOFRune {
+			return l.Error("expected EOF")
+		}
+		return nil
+	}, WithZeroBased())
+	l.StartSync()
+	l.NextToken()
+	errTok, _ := l.NextToken()
+	if errTok.Type != ErrorToken {
+		t.Fatalf("Expected an error token but got %v", *errTok)
+	}
+
+	raw := func(l *Lexer) StateFunc {
+		for l.Next() != EOFRune {
+		}
+		l.Emit(IdentToken)
+		return nil
+	}
+	toks := l.RelexErrorRegion(*errTok, raw)
+	if len(toks) != 1 {
+		t.Fatalf("Expected a single token but got %v", toks)
+	}
+	if toks[0].Value != "abc" || toks[0].Start != errTok.Start {
+		t.Fatalf("Expected abc at %s but got %v at %s", errTok.Start, toks[0], toks[0].Start)
+	}
+}
+
+func TestPeekSignificant(t *testing.T) {
+	cases := []struct {
+		src    string
+		opts   []Option
+		r      rune
+		offset int
+	}{
+		{"  x", nil, 'x', 2},
+		{" // c\n x", []Option{WithLineComment("//")}, 'x', 7},
+		{" // c\n x", nil, '/', 1},
+		{" // c", []Option{WithLineComment("//")}, EOFRune, 5},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil, c.opts...)
+		r, offset := l.PeekSignificant()
+		if r != c.r || offset != c.offset {
+			t.Fatalf("%q: expected %q at %d but got %q at %d", c.src, c.r, c.offset, r, offset)
+		}
+		if l.position != 0 || l.Peek() != ' ' {
+			t.Fatalf("%q: expected position to be restored but got %d", c.src, l.position)
+		}
+	}
+}
+
+func TestAcceptNumberWithSeparators(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+		ok       bool
+		next     rune
+	}{
+		{"1_000", "1_000", true, EOFRune},
+		{"1_000_000;", "1_000_000", true, ';'},
+		{"42", "42", true, EOFRune},
+		{"1__0", "", false, '1'},
+		{"_1", "", false, '_'},
+		{"1_", "", false, '1'},
+		{"1_;", "", false, '1'},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		val, ok := l.AcceptNumberWithSeparators('_')
+		if ok != c.ok || val != c.expected {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.expected, c.ok, val, ok)
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+}
+
+func TestRewind(t *testing.T) {
+	l := NewSub("x\n123.hello  675.world", 2, 22, NumberState)
+	l.Start()
+	first := collect(l)
+	<-l.Done()
+
+	l.Rewind()
+	l.Start()
+	second := collect(l)
+
+	if len(first) != 6 {
+		t.Fatalf("Expected 6 tokens but got %v", first)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Expected %v but got %v", first, second)
+	}
+}
+
+func TestReset(t *testing.T) {
+	l := New("12 9", commentState, WithBufferSize(4))
+	l.StartSync()
+	l.NextToken()
+
+	l.Reset("34", NumberState)
+	l.StartSync()
+	toks := collect(l)
+	if len(toks) != 1 || toks[0].Value != "34" {
+		t.Fatalf("Expected only 34 but got %v", toks)
+	}
+	if toks[0].Start.Offset != 0 || toks[0].End.Offset != 2 {
+		t.Fatalf("Expected 0-2 but got %d-%d", toks[0].Start.Offset, toks[0].End.Offset)
+	}
+}
+
+func TestAcceptExponent(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+		ok       bool
+		next     rune
+	}{
+		{"e10", "e10", true, EOFRune},
+		{"E-3;", "E-3", true, ';'},
+		{"e+7", "e+7", true, EOFRune},
+		{"e", "", false, 'e'},
+		{"e-x", "", false, 'e'},
+		{"10", "", false, '1'},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		val, ok := l.AcceptExponent()
+		if ok != c.ok || val != c.expected {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.expected, c.ok, val, ok)
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+}
+
+func TestPeekPolicy(t *testing.T) {
+	cases := []struct {
+		policy   PeekPolicy
+		expected rune
+		errors   int
+	}{
+		{PeekRuneError, utf8.RuneError, 0},
+		{PeekSentinel, InvalidRune, 0},
+		{PeekError, EOFRune, 1},
+	}
+
+	for _, c := range cases {
+		var s SliceEmitter
+		l := New("a\xffb", nil, WithPeekPolicy(c.policy), WithEmitter(&s))
+		l.Next()
+		if r := l.Peek(); r != c.expected {
+			t.Fatalf("%d: expected %q but got %q", c.policy, c.expected, r)
+		}
+		if len(s.Tokens) != c.errors {
+			t.Fatalf("%d: expected %d errors but got %v", c.policy, c.errors, s.Tokens)
+		}
+		l.Next()
+		l.Backup()
+		if l.position != 1 {
+			t.Fatalf("%d: expected position 1 after backup but got %d", c.policy, l.position)
+		}
+	}
+
+	l := New("�", nil, WithPeekPolicy(PeekSentinel))
+	if r := l.Peek(); r != utf8.RuneError {
+		t.Fatalf("Expected a valid U+FFFD but got %q", r)
+	}
+}
+
+func TestAcceptTwoPhase(t *testing.T) {
+	alnum := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	cases := []struct {
+		src      string
+		expected string
+		ok       bool
+		next     rune
+	}{
+		{"abc12 x", "abc12", true, ' '},
+		{"a", "a", true, EOFRune},
+		{"1abc", "", false, '1'},
+		{"", "", false, EOFRune},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		val, ok := l.AcceptTwoPhase(unicode.IsLetter, alnum)
+		if ok != c.ok || val != c.expected {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.expected, c.ok, val, ok)
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+
+	notQuote := func(r rune) bool { return r != '"' }
+	l := New("ab", nil)
+	if val, ok := l.AcceptTwoPhase(notQuote, notQuote); !ok || val != "ab" {
+		t.Fatalf("Expected %q but got %q, %t", "ab", val, ok)
+	}
+	if val, ok := l.AcceptTwoPhase(notQuote, notQuote); ok {
+		t.Fatalf("Expected nothing at EOF but got %q", val)
+	}
+}
+
+func stuckState(l *Lexer) StateFunc {
+	return stuckState
+}
+
+func TestStuck(t *testing.T) {
+	l := New("abc", stuckState)
+	l.StartSync()
+
+	tok, done := l.NextToken()
+	if done {
+		t.Fatal("Expected an error token but lexer finished")
+	}
+	if tok.Type != ErrorToken || tok.Value != "lexer stuck at position 0" {
+		t.Fatalf("Expected stuck error but got %v", *tok)
+	}
+	if _, done = l.NextToken(); !done {
+		t.Fatal("Expected done but it wasn't.")
+	}
+}
+
+func TestStuckMarkers(t *testing.T) {
+	dedents := 70
+	var dedent StateFunc
+	dedent = func(l *Lexer) StateFunc {
+		if dedents == 0 {
+			return nil
+		}
+		dedents--
+		l.EmitMarker(OpToken)
+		return dedent
+	}
+	toks := New("x", dedent).All()
+	if len(toks) != 70 || toks[69].Type != OpToken {
+		t.Fatalf("Expected 70 markers but got %d ending %v", len(toks), toks[len(toks)-1])
+	}
+}
+
+func TestStuckSiblingStates(t *testing.T) {
+	var step func(n int) StateFunc
+	step = func(n int) StateFunc {
+		return func(l *Lexer) StateFunc {
+			if n < 3 {
+				return step(n + 1)
+			}
+			l.AcceptRun("abc")
+			l.Emit(IdentToken)
+			return nil
+		}
+	}
+	l := New("abc", step(0))
+	l.StartSync()
+	if tok, _ := l.NextToken(); tok.Type != IdentToken {
+		t.Fatalf("Expected abc but got %v", *tok)
+	}
+}
+
+func TestEndMode(t *testing.T) {
+	cases := []struct {
+		mode EndMode
+		eofs int
+	}{
+		{EndClose, 0},
+		{EndToken, 1},
+		{EndBoth, 1},
+	}
+
+	for _, c := range cases {
+		l := New("1 2  ", commentState, WithEndMode(c.mode))
+		l.Start()
+		eofs, done := 0, false
+		for i := 0; i < 10 && !done; i++ {
+			var tok *Token
+			tok, done = l.NextToken()
+			if tok != nil && tok.Type == EOFToken && tok.Value == "" {
+				eofs++
+				if tok.Start.Offset != 5 {
+					t.Fatalf("%d: expected EOF at 5 but got %d", c.mode, tok.Start.Offset)
+				}
+			}
+		}
+		if eofs != c.eofs || !done {
+			t.Fatalf("%d: expected %d EOF tokens and done but got %d and %t", c.mode, c.eofs, eofs, done)
+		}
+
+		<-l.Done()
+		l.Rewind()
+		l.Start()
+		channel := 0
+		for tok := range l.Tokens() {
+			if tok.Type == EOFToken && tok.Value == "" {
+				channel++
+			}
+		}
+		if expected := map[EndMode]int{EndBoth: 1}[c.mode]; channel != expected {
+			t.Fatalf("%d: expected %d EOF tokens on the channel but got %d", c.mode, expected, channel)
+		}
+	}
+}
+
+func TestEndModeReaders(t *testing.T) {
+	src := "1\n2\n3\n4\n"
+	eofs := func(toks []Token) int {
+		n := 0
+		for _, tok := range toks {
+			if tok.Type == EOFToken && tok.Value == "" {
+				n++
+			}
+		}
+		return n
+	}
+	readers := map[string]func(*Lexer) []Token{
+		"ParallelLex": func(l *Lexer) []Token { return l.ParallelLex(4) },
+		"Stream": func(l *Lexer) []Token {
+			var out []Token
+			l.Stream(context.Background(), func(tok Token) error {
+				out = append(out, tok)
+				return nil
+			})
+			return out
+		},
+		"Histogram": func(l *Lexer) []Token {
+			_, values := l.Histogram()
+			return make([]Token, values[""])
+		},
+		"ScanAllSeparated": func(l *Lexer) []Token {
+			toks, _ := l.ScanAllSeparated()
+			return toks
+		},
+		"Workers": func(l *Lexer) []Token {
+			var mu sync.Mutex
+			var out []Token
+			l.Start()
+			l.Workers(2, func(tok Token) {
+				mu.Lock()
+				out = append(out, tok)
+				mu.Unlock()
+			})
+			return out
+		},
+		"PeekTokens": func(l *Lexer) []Token {
+			l.Start()
+			return l.PeekTokens(10)
+		},
+	}
+
+	for _, mode := range []EndMode{EndToken, EndBoth} {
+		for name, read := range readers {
+			if n := eofs(read(New(src, commentState, WithEndMode(mode)))); n != 1 {
+				t.Fatalf("%s %d: expected 1 EOF token but got %d", name, mode, n)
+			}
+		}
+	}
+}
+
+func TestStatePanic(t *testing.T) {
+	l := New("12", func(l *Lexer) StateFunc {
+		l.Next()
+		l.Emit(NumberToken)
+		panic("oops")
+	})
+	l.Start()
+
+	toks := collect(l)
+	if len(toks) != 2 || toks[0].Value != "1" {
+		t.Fatalf("Expected a token and an error but got %v", toks)
+	}
+	if toks[1].Type != ErrorToken || toks[1].Value != "panic in state: oops" {
+		t.Fatalf("Expected panic error but got %v", toks[1])
+	}
+}
+
+func TestFlushOnEnd(t *testing.T) {
+	pending := func(l *Lexer) StateFunc {
+		l.AcceptRun("0123456789")
+		l.Emit(NumberToken)
+		l.AcceptRun("abc")
+		return nil
+	}
+
+	l := New("12abc", pending)
+	l.Start()
+	if s := Signatures(collect(l)); !reflect.DeepEqual(s, []string{"0:12"}) {
+		t.Fatalf("Expected pending text to be dropped but got %q", s)
+	}
+
+	l = New("12abc", pending, WithFlushOnEnd(IdentToken))
+	l.Start()
+	if s := Signatures(collect(l)); !reflect.DeepEqual(s, []string{"0:12", "2:abc"}) {
+		t.Fatalf("Expected pending text to be flushed but got %q", s)
+	}
+}
+
+func TestColumn(t *testing.T) {
+	l := New("ab\n\téx\ny", nil)
+	l.prepare()
+	steps := []struct {
+		next   int
+		ignore bool
+		col    int
+	}{
+		{0, false, 1},
+		{2, false, 3},
+		{1, false, 1},
+		{1, true, 2},
+		{1, false, 3},
+		{1, false, 4},
+		{1, true, 1},
+		{1, false, 2},
+	}
+
+	for i, s := range steps {
+		for n := 0; n < s.next; n++ {
+			l.Next()
+		}
+		if s.ignore {
+			l.Ignore()
+		}
+		if c := l.Column(); c != s.col {
+			t.Fatalf("step %d: expected column %d but got %d", i, s.col, c)
+		}
+	}
+}
+
+func TestAcceptThrough(t *testing.T) {
+	l := New("a = 1; b", nil)
+	r, ok := l.AcceptThrough(";\n")
+	if !ok || r != ';' {
+		t.Fatalf("Expected ';', true but got %q, %t", r, ok)
+	}
+	if l.Current() != "a = 1;" {
+		t.Fatalf("Expected %q but got %q", "a = 1;", l.Current())
+	}
+
+	l.Ignore()
+	r, ok = l.AcceptThrough(";\n")
+	if ok || r != EOFRune {
+		t.Fatalf("Expected EOFRune, false but got %q, %t", r, ok)
+	}
+	if l.Current() != " b" {
+		t.Fatalf("Expected %q but got %q", " b", l.Current())
+	}
+}
+
+func TestAcceptUntil(t *testing.T) {
+	var toks []Token
+	l := New(`"hello"world`, func(l *Lexer) StateFunc {
+		l.Next()
+		l.Ignore()
+		if n := l.AcceptUntil(`"`); n != 5 {
+			t.Errorf("Expected 5 runes but got %d", n)
+		}
+		l.Emit(IdentToken)
+		if n := l.AcceptUntil(`"`); n != 0 {
+			t.Errorf("Expected 0 runes at delimiter but got %d", n)
+		}
+		l.Next()
+		l.Ignore()
+		if n := l.AcceptUntil(`"`); n != 5 {
+			t.Errorf("Expected 5 runes before EOF but got %d", n)
+		}
+		l.Emit(IdentToken)
+		return nil
+	}, WithEmitter(EmitterFunc(func(tok Token) { toks = append(toks, tok) })))
+	l.StartSync()
+
+	got := Signatures(toks)
+	expected := []string{"2:hello", "2:world"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v but got %v", expected, got)
+	}
+}
+
+func TestSkipWhitespacePending(t *testing.T) {
+	for _, skip := range []func(*Lexer){(*Lexer).SkipWhitespace, (*Lexer).SkipLineWhitespace} {
+		var s SliceEmitter
+		l := New("ab  c", nil, WithEmitter(&s))
+		l.SetWhitespaceSignificant(true)
+		l.AcceptRun("ab")
+		skip(l)
+		if len(s.Tokens) != 1 || s.Tokens[0].Value != "  " || s.Tokens[0].Start.Offset != 2 {
+			t.Fatalf("Expected only the whitespace at 2 but got %v", s.Tokens)
+		}
+	}
+}
+
+func TestSkipLineWhitespace(t *testing.T) {
+	l := New(" \t\r\n5", nil)
+	l.SkipLineWhitespace()
+	if l.Current() != " \t\r" {
+		t.Fatalf("Expected %q but got %q", " \t\r", l.Current())
+	}
+	if r := l.Next(); r != '\n' {
+		t.Fatalf("Expected newline but got %q", r)
+	}
+
+	var s SliceEmitter
+	l = New("  ", nil, WithEmitter(&s))
+	l.SkipLineWhitespace()
+	if l.Current() != "  " || len(s.Tokens) != 0 {
+		t.Fatalf("Expected to stop at EOF without emitting but got %v", s.Tokens)
+	}
+
+	l = New(" \u2028x", nil, WithUnicodeLineBreaks())
+	l.SkipLineWhitespace()
+	if r := l.Next(); r != '\u2028' {
+		t.Fatalf("Expected the line separator but got %q", r)
+	}
+
+	l = New("\u2029", nil, WithUnicodeLineBreaks())
+	l.SetWhitespaceSignificant(true)
+	if r, ok := l.AcceptStatementEnd(); !ok || r != '\u2029' {
+		t.Fatalf("Expected the paragraph separator but got %q, %t", r, ok)
+	}
+}
+
+func TestWhitespaceSignificant(t *testing.T) {
+	// Whitespace is only significant within brackets.
+	l := New("a b[c  d] e", func(l *Lexer) StateFunc {
+		for {
+			l.SkipWhitespace()
+			l.Ignore()
+			switch r := l.Next(); r {
+			case EOFRune:
+				return nil
+			case '[':
+				l.Emit(OpToken)
+				l.SetWhitespaceSignificant(true)
+			case ']':
+				l.Emit(OpToken)
+				l.SetWhitespaceSignificant(false)
+			default:
+				l.Emit(IdentToken)
+			}
+		}
+	})
+	l.Start()
+
+	expected := []string{"2:a", "2:b", "1:[", "2:c", "-3:  ", "2:d", "1:]", "2:e"}
+	if s := Signatures(collect(l)); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected %q but got %q", expected, s)
+	}
+}
+
+func TestAcceptStatementEnd(t *testing.T) {
+	cases := []struct {
+		src    string
+		signif bool
+		r      rune
+		ok     bool
+	}{
+		{";x", false, ';', true},
+		{";x", true, ';', true},
+		{"\nx", true, '\n', true},
+		{"\nx", false, EOFRune, false},
+		{"x;", true, EOFRune, false},
+		{"", true, EOFRune, false},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		l.SetWhitespaceSignificant(c.signif)
+		r, ok := l.AcceptStatementEnd()
+		if r != c.r || ok != c.ok {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.r, c.ok, r, ok)
+		}
+		if ok != (l.Current() != "") {
+			t.Fatalf("%q: unexpected current value %q", c.src, l.Current())
+		}
+	}
+}
+
+func TestPeekTokenValue(t *testing.T) {
+	l := New("123.hello", NumberState)
+	l.Start()
+
+	for _, expected := range []string{"123", ".", "hello"} {
+		for i := 0; i < 2; i++ {
+			v, ok := l.PeekTokenValue()
+			if !ok || v != expected {
+				t.Fatalf("Expected to peek %q but got %q, %t", expected, v, ok)
+			}
+		}
+		tok, done := l.NextToken()
+		if done || tok.Value != expected {
+			t.Fatalf("Expected %q but got %v", expected, tok)
+		}
+	}
+
+	if _, ok := l.PeekTokenValue(); ok {
+		t.Fatal("Expected nothing to peek")
+	}
+	if _, done := l.NextToken(); !done {
+		t.Fatal("Expected done but it wasn't.")
+	}
+}
+
+func TestPeekTokens(t *testing.T) {
+	l := New("123.hello  675.world", NumberState)
+	l.Start()
+
+	peeked := Signatures(l.PeekTokens(3))
+	expected := []string{"0:123", "1:.", "2:hello"}
+	if !reflect.DeepEqual(peeked, expected) {
+		t.Fatalf("Expected %v but got %v", expected, peeked)
+	}
+	if v, _ := l.PeekTokenValue(); v != "123" {
+		t.Fatalf("Expected to peek 123 but got %q", v)
+	}
+
+	var got []Token
+	for i := 0; i < 3; i++ {
+		tok, _ := l.NextToken()
+		got = append(got, *tok)
+	}
+	if !reflect.DeepEqual(Signatures(got), expected) {
+		t.Fatalf("Expected %v but got %v", expected, Signatures(got))
+	}
+
+	if n := len(l.PeekTokens(5)); n != 3 {
+		t.Fatalf("Expected 3 remaining tokens but got %d", n)
+	}
+	if n := len(collect(l)); n != 3 {
+		t.Fatalf("Expected to consume 3 tokens but got %d", n)
+	}
+}
+
+func TestZeroBased(t *testing.T) {
+	l := New("1\n2", commentState, WithZeroBased())
+	if c := l.Column(); c != 0 {
+		t.Fatalf("Expected column 0 but got %d", c)
+	}
+	l.Start()
+	toks := collect(l)
+	if toks[0].Line != 0 || toks[1].Line != 1 {
+		t.Fatalf("Expected lines 0 and 1 but got %d and %d", toks[0].Line, toks[1].Line)
+	}
+
+	l = New("x", WhitespaceState, WithZeroBased())
+	l.StartSync()
+	tok, _ := l.NextToken()
+	if tok.Type != ErrorToken || tok.Line != 0 {
+		t.Fatalf("Expected an error on line 0 but got %v on %d", *tok, tok.Line)
+	}
+}
+
+func TestEmitSplit(t *testing.T) {
+	l := New("x key=value", func(l *Lexer) StateFunc {
+		l.Next()
+		l.Emit(IdentToken)
+		l.Next()
+		l.Ignore()
+		l.AcceptRun("abcdefghijklmnopqrstuvwxyz=")
+		l.EmitSplit('=', IdentToken, NumberToken)
+		return nil
+	})
+	l.Start()
+	toks := collect(l)
+
+	expected := []string{"2:x", "2:key", "0:value"}
+	if s := Signatures(toks); !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Expected %q but got %q", expected, s)
+	}
+	if toks[1].Position != 2 || toks[2].Position != 6 {
+		t.Fatalf("Expected positions 2 and 6 but got %d and %d", toks[1].Position, toks[2].Position)
+	}
+	if h := l.TokenHistory(2); len(h) != 2 || h[0].Value != "key" || h[1].Value != "value" {
+		t.Fatalf("Expected the parts in the history but got %v", h)
+	}
+
+	l = New("k=v", func(l *Lexer) StateFunc {
+		l.AcceptRun("kv=")
+		l.EmitSplit('=', IdentToken, NumberToken)
+		return nil
+	}, WithEmitInterceptor(func(tok *Token) bool { return tok.Type != NumberToken }))
+	l.Start()
+	if s := Signatures(collect(l)); !reflect.DeepEqual(s, []string{"2:k"}) {
+		t.Fatalf("Expected only the intercepted key but got %q", s)
+	}
+
+	l = New("a=b=c", func(l *Lexer) StateFunc {
+		l.AcceptRun("abc=")
+		l.EmitSplit('=', IdentToken, IdentToken)
+		return nil
+	})
+	l.StartSync()
+	if tok, _ := l.NextToken(); tok.Type != ErrorToken {
+		t.Fatalf("Expected an error but got %v", *tok)
+	}
+}
+
+func TestTokenColumn(t *testing.T) {
+	l := New("ab\ncd é\tf", commentState)
+	l.prepare()
+	l.AcceptRun("abcdef")
+	l.Emit(IdentToken)
+	l.Next()
+	l.Ignore()
+	l.AcceptRun("abcdef")
+	l.Peek()
+	l.Emit(IdentToken)
+	l.Next()
+	l.Ignore()
+	l.Next()
+	l.Emit(IdentToken)
+	l.AcceptRun("\t")
+	l.Ignore()
+	l.Next()
+	l.Emit(IdentToken)
+	close(l.tokens)
+
+	expected := []struct {
+		val  string
+		line int
+		col  int
+	}{
+		{"ab", 1, 1},
+		{"cd", 2, 1},
+		{"é", 2, 4},
+		{"f", 2, 6},
+	}
+	for _, e := range expected {
+		tok, _ := l.NextToken()
+		if tok.Value != e.val || tok.Line != e.line || tok.Column != e.col {
+			t.Fatalf("Expected %q at %d:%d but got %q at %d:%d", e.val, e.line, e.col, tok.Value, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestAcceptBaseNumber(t *testing.T) {
+	cases := []struct {
+		src      string
+		base     int
+		expected string
+		ok       bool
+		next     rune
+	}{
+		{"1011", 2, "1011", true, EOFRune},
+		{"102", 2, "10", true, '2'},
+		{"2", 2, "", false, '2'},
+		{"0755 ", 8, "0755", true, ' '},
+		{"789", 8, "7", true, '8'},
+		{"zZ9a!", 36, "zZ9a", true, '!'},
+		{"FFg", 16, "FF", true, 'g'},
+		{"1", 37, "", false, '1'},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		val, ok := l.AcceptBaseNumber(c.base)
+		if ok != c.ok || val != c.expected {
+			t.Fatalf("%q: expected %q, %t but got %q, %t", c.src, c.expected, c.ok, val, ok)
+		}
+		if r := l.Next(); r != c.next {
+			t.Fatalf("%q: expected next %q but got %q", c.src, c.next, r)
+		}
+	}
+}
+
+func TestBackupAcrossLines(t *testing.T) {
+	l := New("a\nb\n\nc", nil)
+	lines := []int{1, 1, 2, 2, 3, 4}
+	for i, expected := range lines {
+		if l.line != expected {
+			t.Fatalf("step %d: expected line %d but got %d", i, expected, l.line)
+		}
+		l.Next()
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		l.Backup()
+		if l.line != lines[i] {
+			t.Fatalf("backup %d: expected line %d but got %d", i, lines[i], l.line)
+		}
+	}
+	if offsets := l.LineOffsets(); len(offsets) != 0 {
+		t.Fatalf("Expected no offsets after backing up but got %v", offsets)
+	}
+
+	l.AcceptCount(3)
+	if l.line != 2 || l.Column() != 2 {
+		t.Fatalf("Expected 2:2 but got %d:%d", l.line, l.Column())
+	}
+}
+
+func TestUnicodeLineBreaks(t *testing.T) {
+	letters := func(l *Lexer) StateFunc {
+		for r := l.Next(); r != EOFRune; r = l.Next() {
+			if unicode.IsLetter(r) {
+				l.Emit(IdentToken)
+			} else {
+				l.Ignore()
+			}
+		}
+		return nil
+	}
+	src := "a\u2028b\u2029 c\nd"
+
+	var lines []string
+	for _, tok := range New(src, letters, WithUnicodeLineBreaks()).All() {
+		lines = append(lines, tok.Value+"@"+tok.Start.String())
+	}
+	expected := []string{"a@1:1", "b@2:1", "c@3:2", "d@4:1"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Expected %v but got %v", expected, lines)
+	}
+
+	lines = nil
+	for _, tok := range New(src, letters).All() {
+		lines = append(lines, tok.Value+"@"+tok.Start.String())
+	}
+	expected = []string{"a@1:1", "b@1:3", "c@1:6", "d@2:1"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Expected %v without the option but got %v", expected, lines)
+	}
+
+	l := New(src, nil, WithUnicodeLineBreaks())
+	l.AcceptCount(3)
+	if p := l.Pos(); p.Line != 2 || p.Column != 2 {
+		t.Fatalf("Expected 2:2 but got %s", p)
+	}
+	l.Backup()
+	l.Backup()
+	if p := l.Pos(); p.Line != 1 || p.Column != 2 {
+		t.Fatalf("Expected 1:2 after backing up but got %s", p)
+	}
+	if got := l.LineOffsets(); len(got) != 0 {
+		t.Fatalf("Expected the backed up line break to be dropped but got %v", got)
+	}
+}
+
+func TestTokenSpan(t *testing.T) {
+	src := "111 222\n  333"
+	l := New(src, commentState)
+	l.Start()
+	toks := collect(l)
+
+	second := toks[1]
+	if src[second.Start.Offset:second.End.Offset] != "222" {
+		t.Fatalf("Expected span of 222 but got %q", src[second.Start.Offset:second.End.Offset])
+	}
+	if second.Start.Offset != 4 || second.End.Offset != 7 {
+		t.Fatalf("Expected 4-7 but got %d-%d", second.Start.Offset, second.End.Offset)
+	}
+	if s := toks[2].Start.String(); s != "2:3" {
+		t.Fatalf("Expected 2:3 but got %q", s)
+	}
+
+	l = New(src, nil)
+	l.AcceptCount(10)
+	if p := l.Pos(); p != (Position{10, 2, 3}) {
+		t.Fatalf("Expected 10 at 2:3 but got %d at %s", p.Offset, p)
+	}
+}
+
+func TestMultilineTokenLine(t *testing.T) {
+	toks := New("1\n/* a\nb\nc */ 2", func(l *Lexer) StateFunc {
+		l.Next()
+		l.Emit(NumberToken)
+		l.SkipWhitespace()
+		l.Ignore()
+		l.AcceptThrough("/")
+		l.AcceptThrough("/")
+		l.Emit(OpToken)
+		l.SkipWhitespace()
+		l.Ignore()
+		l.Next()
+		l.Emit(NumberToken)
+		return nil
+	}).All()
+
+	if toks[1].Line != 2 || toks[1].Start.Line != 2 || toks[1].End.Line != 4 {
+		t.Fatalf("Expected comment on lines 2-4 but got %d-%d", toks[1].Start.Line, toks[1].End.Line)
+	}
+	if toks[2].Value != "2" || toks[2].Line != 4 {
+		t.Fatalf("Expected 2 on line 4 but got %v on %d", toks[2], toks[2].Line)
+	}
+}
+
+func TestLineText(t *testing.T) {
+	src := "1 22\r\n  333 # x\n\n4"
+	toks := New(src, commentState, WithLineText()).All()
+
+	expected := []string{"1 22", "1 22", "  333 # x", "4"}
+	for i, tok := range toks {
+		if tok.LineText != expected[i] {
+			t.Fatalf("%v: expected line %q but got %q", tok, expected[i], tok.LineText)
+		}
+	}
+
+	l := NewFromReader(iotest.OneByteReader(strings.NewReader(src)), commentState, WithLineText())
+	l.Start()
+	if got := collect(l); !reflect.DeepEqual(got, toks) {
+		t.Fatalf("Expected reader tokens %v but got %v", toks, got)
+	}
+}
+
+func TestTokenPositionIsStart(t *testing.T) {
+	toks := New("abc def", func(l *Lexer) StateFunc {
+		l.AcceptRun("abcdef")
+		l.Emit(IdentToken)
+		l.SkipWhitespace()
+		l.Ignore()
+		l.AcceptRun("abcdef")
+		l.Emit(IdentToken)
+		return nil
+	}).All()
+
+	if toks[1].Value != "def" || toks[1].Position != 4 {
+		t.Fatalf("Expected def at 4 but got %v at %d", toks[1], toks[1].Position)
+	}
+	if toks[1].End.Offset != 7 {
+		t.Fatalf("Expected def to end at 7 but got %d", toks[1].End.Offset)
+	}
+}
+
+func TestTokenHistory(t *testing.T) {
+	var got, last []Token
+	l := New("1 2 3 4", func(l *Lexer) StateFunc {
+		for l.AcceptRun("0123456789") > 0 {
+			l.Emit(NumberToken)
+			l.SkipWhitespace()
+			l.Ignore()
+		}
+		got = l.TokenHistory(2)
+		last = l.TokenHistory(10)
+		return nil
+	}, WithEmitter(&SliceEmitter{}))
+	l.StartSync()
+
+	if s := Signatures(got); !reflect.DeepEqual(s, []string{"0:3", "0:4"}) {
+		t.Errorf("Expected last two tokens but got %v", s)
+	}
+	if len(last) != 4 {
+		t.Errorf("Expected 4 tokens but got %d", len(last))
+	}
+
+	src := strings.Repeat("1 ", 2*tokenHistorySize)
+	l = New(src, func(l *Lexer) StateFunc {
+		for l.AcceptRun("0123456789") > 0 {
+			l.Emit(NumberToken)
+			l.Accept(" ")
+			l.Ignore()
+		}
+		got = l.TokenHistory(3 * tokenHistorySize)
+		return nil
+	}, WithEmitter(&SliceEmitter{}))
+	l.StartSync()
+
+	if len(got) != tokenHistorySize {
+		t.Fatalf("Expected %d tokens but got %d", tokenHistorySize, len(got))
+	}
+	if got[0].Start.Offset != tokenHistorySize*2 {
+		t.Errorf("Expected oldest token at %d but got %d", tokenHistorySize*2, got[0].Start.Offset)
+	}
+}
+
+func TestStateDepth(t *testing.T) {
+	// Each '(' pushes a state which is resumed on ')'.
+	var parenState StateFunc
+	parenState = func(l *Lexer) StateFunc {
+		switch l.Next() {
+		case '(':
+			l.Emit(OpToken)
+			return l.PushState(parenState, parenState)
+		case ')':
+			l.Emit(OpToken)
+			return l.PopState()
+		}
+		return nil
+	}
+
+	var s SliceEmitter
+	l := New("(())", parenState, WithMaxStateDepth(2), WithEmitter(&s))
+	l.StartSync()
+	if len(s.Tokens) != 4 || s.Tokens[3].Type == ErrorToken {
+		t.Fatalf("Expected 4 tokens but got %v", s.Tokens)
+	}
+
+	s.Tokens = nil
+	l = New("((()))", parenState, WithMaxStateDepth(2), WithEmitter(&s))
+	l.StartSync()
+	last := s.Tokens[len(s.Tokens)-1]
+	if last.Type != ErrorToken || last.Value != "maximum state depth 2 exceeded" {
+		t.Fatalf("Expected depth error but got %v", s.Tokens)
+	}
+
+	s.Tokens = nil
+	l = New(strings.Repeat("(", DefaultMaxStateDepth+1), parenState, WithEmitter(&s))
+	l.StartSync()
+	if last := s.Tokens[len(s.Tokens)-1]; last.Type != ErrorToken {
+		t.Fatalf("Expected depth error at the default limit but got %v", last)
+	}
+}
+
+func TestPosString(t *testing.T) {
+	l := New("ab\ncd\n  efg", commentState)
+	l.AcceptCount(10)
+	if s := l.Pos().String(); s != "3:5" {
+		t.Fatalf("Expected 3:5 but got %q", s)
+	}
+
+	l = New("1\n  22", commentState)
+	l.Start()
+	toks := collect(l)
+	if s := fmt.Sprint(toks[1].Pos()); s != "2:3" {
+		t.Fatalf("Expected 2:3 but got %q", s)
+	}
+}
+
+func TestNextN(t *testing.T) {
+	l := New("cafe!", nil)
+	runes, ok := l.NextN(4)
+	if !ok || string(runes) != "cafe" {
+		t.Fatalf("Expected %q but got %q, %v", "cafe", string(runes), ok)
+	}
+	if r := l.Peek(); r != '!' {
+		t.Fatalf("Expected '!' but got %q", r)
+	}
+	l.Backup()
+	if l.Current() != "caf" {
+		t.Fatalf("Expected %q but got %q", "caf", l.Current())
+	}
+
+	l = New("ab", nil)
+	if runes, ok := l.NextN(3); ok || string(runes) != "ab" {
+		t.Fatalf("Expected %q and false but got %q, %v", "ab", string(runes), ok)
+	}
+}
+
+func TestPeekN(t *testing.T) {
+	l := New("=>", nil)
+	if got := l.PeekN(2); !reflect.DeepEqual(got, []rune{'=', '>'}) {
+		t.Fatalf("Expected [= >] but got %q", got)
+	}
+	if got := l.PeekN(5); !reflect.DeepEqual(got, []rune{'=', '>'}) {
+		t.Fatalf("Expected [= >] at EOF but got %q", got)
+	}
+	if r := l.Next(); r != '=' {
+		t.Fatalf("Expected '=' but got %q", r)
+	}
+
+	l = New("a\nb", nil)
+	l.Next()
+	l.PeekN(3)
+	if p := l.Pos(); p.Line != 1 || p.Offset != 1 {
+		t.Fatalf("Expected line 1 offset 1 but got %d at %s", p.Offset, p)
+	}
+	l.Next()
+	if p := l.Pos(); p.Line != 2 {
+		t.Fatalf("Expected line 2 but got %s", p)
+	}
+}
+
+func TestEmitInterceptor(t *testing.T) {
+	intercept := func(tok *Token) bool {
+		switch tok.Value {
+		case "2":
+			return false
+		case "3":
+			tok.Type = IdentToken
+			tok.Value = "three"
+		}
+		return true
+	}
+	var s SliceEmitter
+	l := New("1 2 3", commentState, WithEmitInterceptor(intercept), WithEmitter(&s))
+	l.StartSync()
+
+	expected := []string{"0:1", "2:three"}
+	if got := Signatures(s.Tokens); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v but got %v", expected, got)
+	}
+	if got := Signatures(l.TokenHistory(3)); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected history %v but got %v", expected, got)
+	}
+}
+
+func TestEmitValue(t *testing.T) {
+	var s SliceEmitter
+	l := New("x TRUE", func(l *Lexer) StateFunc {
+		l.AcceptCount(2)
+		l.Ignore()
+		l.AcceptCount(4)
+		l.EmitValue(IdentToken, strings.ToLower(l.Current()))
+		return nil
+	}, WithEmitter(&s))
+	l.StartSync()
+
+	tok := s.Tokens[0]
+	if tok.Value != "true" {
+		t.Fatalf("Expected %q but got %q", "true", tok.Value)
+	}
+	if tok.Start.Offset != 2 || tok.End.Offset != 6 {
+		t.Fatalf("Expected 2-6 but got %d-%d", tok.Start.Offset, tok.End.Offset)
+	}
+}
+
+func TestEmitLazy(t *testing.T) {
+	calls := 0
+	upper := func() string {
+		calls++
+		return "ABC"
+	}
+	toks := New("abc", func(l *Lexer) StateFunc {
+		l.AcceptCount(3)
+		l.EmitLazy(IdentToken, upper)
+		return nil
+	}).All()
+
+	if calls != 0 {
+		t.Fatalf("Expected no computation before reading but got %d", calls)
+	}
+	tok := toks[0]
+	for i := 0; i < 2; i++ {
+		if v := tok.Text(); v != "ABC" {
+			t.Fatalf("Expected ABC but got %q", v)
+		}
+	}
+	if v := toks[0].Text(); v != "ABC" || calls != 1 {
+		t.Fatalf("Expected a single computation but got %d", calls)
+	}
+	if tok.End.Offset != 3 {
+		t.Fatalf("Expected the token to span 3 bytes but got %d", tok.End.Offset)
+	}
+	if v := (Token{Value: "x"}).Text(); v != "x" {
+		t.Fatalf("Expected x but got %q", v)
+	}
+	if r := Render(toks); r != "ABC" || tok.Signature() != "2:ABC" {
+		t.Fatalf("Expected the helpers to use the computed value but got %q and %q", r, tok.Signature())
+	}
+}
+
+func TestEmitTrimmed(t *testing.T) {
+	var s SliceEmitter
+	l := New("  hi \n x", func(l *Lexer) StateFunc {
+		l.AcceptCount(6)
+		l.EmitTrimmed(IdentToken)
+		l.AcceptCount(2)
+		l.Emit(IdentToken)
+		return nil
+	}, WithEmitter(&s))
+	l.StartSync()
+
+	if s.Tokens[0].Value != "hi" {
+		t.Fatalf("Expected %q but got %q", "hi", s.Tokens[0].Value)
+	}
+	if p := s.Tokens[0].Start; p.Offset != 0 || p.Column != 1 {
+		t.Fatalf("Expected start at 0 but got %d at %s", p.Offset, p)
+	}
+	if p := s.Tokens[1].Start; p.Line != 2 || p.Column != 1 {
+		t.Fatalf("Expected 2:1 but got %s", p)
+	}
+}
+
+func TestParallelLex(t *testing.T) {
+	src := strings.Repeat("12 3é4\n# c\n5\n", 200)
+	l := New(src, commentState)
+	l.Start()
+	expected := collect(l)
+
+	for _, n := range []int{1, 3, 8, 1000} {
+		got := New(src, commentState).ParallelLex(n)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%d chunks: got %d tokens, expected %d", n, len(got), len(expected))
+		}
+	}
+
+	// Only split before a '5' line.
+	five := func(src string, i int) bool { return src[i] == '5' }
+	got := New(src, commentState, WithChunkBoundary(five)).ParallelLex(4)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("custom boundary: got %d tokens, expected %d", len(got), len(expected))
+	}
+}
+
+func TestRemainingIsBlank(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected bool
+	}{
+		{"1 \t\n ", true},
+		{"1", true},
+		{"1  \n x", false},
+		{"1 2", false},
+	}
+
+	for _, c := range cases {
+		l := New(c.src, nil)
+		l.Next()
+		if got := l.RemainingIsBlank(); got != c.expected {
+			t.Fatalf("%q: expected %t but got %t", c.src, c.expected, got)
+		}
+		if p := l.Pos(); p.Offset != 1 || p.Line != 1 {
+			t.Fatalf("%q: expected nothing consumed but at %d %s", c.src, p.Offset, p)
+		}
+	}
+}
+
+func BenchmarkLexLines(b *testing.B) {
+	src := strings.Repeat("12 345 # comment\n  6789\n", 1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		New(src, commentState, WithEmitter(EmitterFunc(func(Token) {}))).StartSync()
+	}
 }
@@ -0,0 +1,187 @@
+package lexer
+
+import "time"
+
+// Option configures a Lexer.
+type Option func(*Lexer)
+
+// WithKeywords registers a table of keywords and the token types they should
+// be emitted as.
+func WithKeywords(keywords map[string]TokenType) Option {
+	return func(l *Lexer) {
+		l.keywords = keywords
+	}
+}
+
+// WithTrivia sends all ignored input as TriviaTokens on a separate channel,
+// available from Trivia.
+func WithTrivia() Option {
+	return func(l *Lexer) {
+		l.withTrivia = true
+	}
+}
+
+// WithStrictTokenTypes causes Emit to push an error token for any token type
+// that has not been registered.
+func WithStrictTokenTypes() Option {
+	return func(l *Lexer) {
+		l.strict = true
+	}
+}
+
+// WithFoldKeywords matches keywords case-insensitively. Token values retain
+// their original case.
+func WithFoldKeywords() Option {
+	return func(l *Lexer) {
+		l.foldKeys = true
+	}
+}
+
+// WithTerminator ends the input at the first occurrence of r. Next returns
+// EOFRune on reaching it.
+func WithTerminator(r rune) Option {
+	return func(l *Lexer) {
+		l.terminator = r
+	}
+}
+
+// WithMaxLines ends the input after n lines. The newline ending line n is
+// the last rune returned by Next.
+func WithMaxLines(n int) Option {
+	return func(l *Lexer) {
+		l.maxLines = n
+	}
+}
+
+// WithEmitter delivers tokens to e instead of the tokens channel. The
+// channel is still closed when lexing completes.
+func WithEmitter(e Emitter) Option {
+	return func(l *Lexer) {
+		l.emitter = e
+	}
+}
+
+// WithLineComment sets the prefix of comments running to the end of the line,
+// which are skipped by PeekSignificant.
+func WithLineComment(prefix string) Option {
+	return func(l *Lexer) {
+		l.comment = prefix
+	}
+}
+
+// WithBufferSize sets the size of the token channel buffer. The default is
+// half the length of the source.
+func WithBufferSize(n int) Option {
+	return func(l *Lexer) {
+		l.bufSize = n
+	}
+}
+
+// WithPeekPolicy sets how Peek reports invalid UTF-8. The default is
+// PeekRuneError.
+func WithPeekPolicy(p PeekPolicy) Option {
+	return func(l *Lexer) {
+		l.peekPolicy = p
+	}
+}
+
+// WithFlushOnEnd emits any value still current when the states finish as a
+// token of type t. By default it is discarded.
+func WithFlushOnEnd(t TokenType) Option {
+	return func(l *Lexer) {
+		l.flush = true
+		l.flushType = t
+	}
+}
+
+// WithZeroBased numbers lines and columns from 0 rather than 1.
+func WithZeroBased() Option {
+	return func(l *Lexer) {
+		l.zeroBased = true
+	}
+}
+
+// WithStrictUTF8 treats invalid UTF-8 as the end of the input. Next returns
+// EOFRune on reaching it and an error token is emitted after the states
+// finish.
+func WithStrictUTF8() Option {
+	return func(l *Lexer) {
+		l.strictUTF8 = true
+	}
+}
+
+// WithMaxStateDepth limits the number of states saved by PushState. The
+// default is DefaultMaxStateDepth.
+func WithMaxStateDepth(n int) Option {
+	return func(l *Lexer) {
+		l.maxDepth = n
+	}
+}
+
+// WithMaxCommentNesting limits the depth of nesting accepted by
+// AcceptComment and AcceptBalanced. The default is DefaultMaxCommentNesting.
+func WithMaxCommentNesting(n int) Option {
+	return func(l *Lexer) {
+		l.maxNesting = n
+	}
+}
+
+// WithEmitInterceptor calls f with each token passed to Emit. Tokens for
+// which f returns false are dropped.
+func WithEmitInterceptor(f EmitInterceptor) Option {
+	return func(l *Lexer) {
+		l.intercept = f
+	}
+}
+
+// WithChunkBoundary sets where ParallelLex may split the source. f reports
+// whether a chunk may end before offset i of src, which is never 0.
+func WithChunkBoundary(f func(src string, i int) bool) Option {
+	return func(l *Lexer) {
+		l.boundary = f
+	}
+}
+
+// WithEmitTimeout stops the lexer if a token sent to the tokens channel has
+// not been received within d, so that an abandoned lexer does not block
+// forever. The channel is then closed without the remaining tokens, and
+// NextToken returns an error token once it has been drained.
+func WithEmitTimeout(d time.Duration) Option {
+	return func(l *Lexer) {
+		l.sendTimeout = d
+	}
+}
+
+// WithEndMode sets how the end of the tokens is signalled. The default is
+// EndClose.
+func WithEndMode(m EndMode) Option {
+	return func(l *Lexer) {
+		l.endMode = m
+	}
+}
+
+// WithLineText sets LineText on each token to the source line on which it
+// starts. Tokens on the same line share the memory of the source, but each
+// token holds its whole line however long it is.
+func WithLineText() Option {
+	return func(l *Lexer) {
+		l.lineText = true
+	}
+}
+
+// WithUnicodeLineBreaks counts the Unicode line and paragraph separators,
+// U+2028 and U+2029, as line breaks as well as '\n'.
+func WithUnicodeLineBreaks() Option {
+	return func(l *Lexer) {
+		l.uniBreaks = true
+	}
+}
+
+// WithRetainedHistory keeps the last n runes read before each emit, so that
+// Backup can step back across the emit by up to n runes. The start of the
+// next value moves back with the position.
+func WithRetainedHistory(n int) Option {
+	return func(l *Lexer) {
+		l.retain = n
+	}
+}
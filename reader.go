@@ -0,0 +1,106 @@
+package lexer
+
+import (
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// readSize is the number of bytes requested from a reader at a time.
+const readSize = 4096
+
+// readerBufferSize is the default token buffer size for reader input, whose
+// length is not known in advance.
+const readerBufferSize = 64
+
+// NewFromReader creates a lexer which reads its source lazily from r. Input
+// is only read as far as the lexer looks ahead, and input before the start
+// of the current value is discarded, so a reader lexer cannot be rewound.
+// A read error other than io.EOF ends the input and is emitted as an error
+// once the states finish.
+func NewFromReader(r io.Reader, start StateFunc, opts ...Option) *Lexer {
+	l := New("", start, opts...)
+	l.reader = r
+	l.readBuf = make([]byte, readSize)
+	if l.bufSize <= 0 {
+		l.bufSize = readerBufferSize
+	}
+	return l
+}
+
+// fill reads from the reader until a whole rune is buffered at the position
+// or the reader is exhausted.
+func (l *Lexer) fill() {
+	if l.reader == nil {
+		return
+	}
+	for !l.readEOF && !utf8.FullRuneInString(l.source[l.position-l.offset:]) {
+		l.read()
+	}
+}
+
+// fillBytes reads from the reader until n bytes are buffered at the position
+// or the reader is exhausted.
+func (l *Lexer) fillBytes(n int) {
+	if l.reader == nil {
+		return
+	}
+	for !l.readEOF && len(l.source)-(l.position-l.offset) < n {
+		l.read()
+	}
+}
+
+// read appends the next read from the reader to the source. The read grows
+// with the buffered input, so that keeping a lot of it buffered does not
+// make appending to it quadratic.
+func (l *Lexer) read() {
+	if len(l.source) > len(l.readBuf) {
+		l.readBuf = make([]byte, len(l.source))
+	}
+	n, err := l.reader.Read(l.readBuf)
+	l.source += string(l.readBuf[:n])
+	if err != nil {
+		l.readEOF = true
+		if err != io.EOF {
+			l.readErr = err
+		}
+	}
+}
+
+// discard drops buffered reader input before the start, which can no longer
+// be backed up to, along with the offsets of the line breaks within it.
+func (l *Lexer) discard() {
+	to := l.start
+	if l.retain > 0 {
+		to = l.lineBreakBefore(l.retainedFrom())
+	}
+	if l.marks > 0 && l.keepFrom < to {
+		to = l.keepFrom
+	}
+	if l.lineText {
+		if begin := l.lineBreakBefore(l.start); begin < to {
+			to = begin
+		}
+	}
+	if l.reader == nil || to == l.offset {
+		return
+	}
+	l.source = l.source[to-l.offset:]
+	l.offset = to
+	l.lines = l.lines[sort.SearchInts(l.lines, to):]
+}
+
+// retainedFrom returns the offset of the earliest rune retained in the
+// history.
+func (l *Lexer) retainedFrom() int {
+	from := l.position
+	for node := l.history.start; node != nil; node = node.next {
+		from -= node.w
+	}
+	return from
+}
+
+// slice returns the source between the offsets from and to.
+func (l *Lexer) slice(from, to int) string {
+	return l.source[from-l.offset : to-l.offset]
+}
@@ -0,0 +1,150 @@
+package lexer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNewFromReader(t *testing.T) {
+	src := "123 456"
+	l := NewFromReader(bytes.NewReader([]byte(src)), NewlineState)
+	l.Start()
+	got := collect(l)
+
+	l = New(src, NewlineState)
+	l.Start()
+	expected := collect(l)
+
+	if len(got) != 2 || !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestNewFromReaderOneByte(t *testing.T) {
+	cases := []struct {
+		src   string
+		state StateFunc
+	}{
+		{"123.hello  675.world", NumberState},
+		{"123\n456\n789", NewlineState},
+		{"notaspace", WhitespaceState},
+		{strings.Repeat("12 3é4\n", 2000), commentState},
+	}
+
+	for _, c := range cases {
+		l := NewFromReader(iotest.OneByteReader(strings.NewReader(c.src)), c.state)
+		l.Start()
+		got := collect(l)
+
+		l = New(c.src, c.state)
+		l.Start()
+		expected := collect(l)
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%.20q: got %v, expected %v", c.src, got, expected)
+		}
+	}
+}
+
+func TestNewFromReaderDiscards(t *testing.T) {
+	src := strings.Repeat("1234 ", 10000)
+	var l *Lexer
+	largest, emitted := 0, 0
+	l = NewFromReader(strings.NewReader(src), commentState, WithEmitter(EmitterFunc(func(Token) {
+		emitted++
+		if n := len(l.source); n > largest {
+			largest = n
+		}
+	})))
+	l.StartSync()
+	if emitted != 10000 || largest == 0 {
+		t.Fatalf("Expected 10000 tokens from a filled buffer but got %d from %d bytes", emitted, largest)
+	}
+	if largest > 2*readSize {
+		t.Errorf("buffered %d bytes, expected at most %d", largest, 2*readSize)
+	}
+}
+
+type failingReader struct{ io.Reader }
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("boom")
+	}
+	return n, err
+}
+
+func TestNewFromReaderError(t *testing.T) {
+	l := NewFromReader(failingReader{strings.NewReader("12")}, NumberState)
+	l.Start()
+	toks := collect(l)
+	if len(toks) != 2 || toks[0].Value != "12" || toks[1].Type != ErrorToken || toks[1].Value != "read error: boom" {
+		t.Fatalf("got %v", toks)
+	}
+}
+
+func TestNewFromReaderMark(t *testing.T) {
+	src := strings.Repeat("1234 ", 500)
+	l := NewFromReader(iotest.OneByteReader(strings.NewReader(src)), nil, WithEmitter(&SliceEmitter{}))
+	l.AcceptCount(2)
+	m := l.Mark()
+	for _, ok := l.AcceptCount(5); ok; _, ok = l.AcceptCount(5) {
+		l.Emit(NumberToken)
+	}
+	l.Restore(m)
+	if r := l.Next(); r != '3' {
+		t.Fatalf("Expected '3' but got %q", r)
+	}
+}
+
+func TestNewFromReaderRetainedHistory(t *testing.T) {
+	src := strings.Repeat("1234\n", 500)
+	l := NewFromReader(iotest.OneByteReader(strings.NewReader(src)), nil, WithEmitter(&SliceEmitter{}), WithRetainedHistory(2))
+	for _, ok := l.AcceptCount(5); ok; _, ok = l.AcceptCount(5) {
+		l.Emit(NumberToken)
+		l.Backup()
+		l.Backup()
+		if l.Current() != "" || l.Column() != 4 {
+			t.Fatalf("Expected column 4 but got %d", l.Column())
+		}
+		l.AcceptCount(2)
+		l.Ignore()
+	}
+}
+
+func TestNewFromReaderMaxLines(t *testing.T) {
+	l := NewFromReader(strings.NewReader("1\n22\n333"), commentState, WithMaxLines(2))
+	l.Start()
+	var values []string
+	for _, tok := range collect(l) {
+		values = append(values, tok.Value)
+	}
+	if expected := []string{"1", "22"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("Expected %q but got %q", expected, values)
+	}
+}
+
+func TestNewFromReaderRelease(t *testing.T) {
+	src := strings.Repeat("1234 ", 2000)
+	l := NewFromReader(strings.NewReader(src), nil, WithEmitter(&SliceEmitter{}))
+	m := l.Mark()
+	for i := 0; i < 1000; i++ {
+		l.AcceptCount(5)
+		l.Emit(NumberToken)
+	}
+	if len(l.source) < 5000 {
+		t.Fatalf("Expected the marked input to be kept but got %d bytes", len(l.source))
+	}
+	l.Release(m)
+	l.AcceptCount(5)
+	l.Emit(NumberToken)
+	if len(l.source) > 2*readSize {
+		t.Fatalf("Expected the input to be discarded but kept %d bytes", len(l.source))
+	}
+}
@@ -0,0 +1,96 @@
+package lexer
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// TokenSpec describes a token type for registration.
+type TokenSpec struct {
+	Type     TokenType
+	Name     string
+	Category string
+}
+
+var registry = struct {
+	sync.RWMutex
+	specs map[TokenType]TokenSpec
+}{specs: make(map[TokenType]TokenSpec)}
+
+// Register configures the names and categories of the given token types. An
+// error is returned, and nothing registered, if any type is already
+// registered or repeated.
+func Register(specs []TokenSpec) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	seen := make(map[TokenType]bool, len(specs))
+	for _, s := range specs {
+		if _, ok := registry.specs[s.Type]; ok || seen[s.Type] {
+			return fmt.Errorf("token type %d already registered", s.Type)
+		}
+		seen[s.Type] = true
+	}
+	for _, s := range specs {
+		registry.specs[s.Type] = s
+	}
+	return nil
+}
+
+// RegisterTokenName sets the name of the token type t, registering it if
+// necessary.
+func RegisterTokenName(t TokenType, name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	s := registry.specs[t]
+	s.Type, s.Name = t, name
+	registry.specs[t] = s
+}
+
+// unregister removes the given token types from the registry.
+func unregister(types ...TokenType) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, t := range types {
+		delete(registry.specs, t)
+	}
+}
+
+func lookup(t TokenType) (TokenSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	s, ok := registry.specs[t]
+	return s, ok
+}
+
+// registered reports whether t is a builtin or registered token type.
+func registered(t TokenType) bool {
+	switch t {
+	case ErrorToken, EOFToken, TriviaToken, WhitespaceToken:
+		return true
+	}
+	_, ok := lookup(t)
+	return ok
+}
+
+// Name returns the registered name of the token type, if any.
+func (t TokenType) Name() string {
+	s, _ := lookup(t)
+	return s.Name
+}
+
+// Category returns the registered category of the token type, if any.
+func (t TokenType) Category() string {
+	s, _ := lookup(t)
+	return s.Category
+}
+
+// String returns the registered name of the token type, or its number if it
+// has none.
+func (t TokenType) String() string {
+	if name := t.Name(); name != "" {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
@@ -0,0 +1,120 @@
+package lexer
+
+import (
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	const (
+		tNumber TokenType = iota + 100
+		tPlus
+		tMinus
+	)
+	t.Cleanup(func() { unregister(tNumber, tPlus, tMinus, 150) })
+
+	err := Register([]TokenSpec{
+		{tNumber, "NUMBER", "literal"},
+		{tPlus, "PLUS", "operator"},
+		{tMinus, "MINUS", "operator"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %s", err)
+	}
+
+	if tNumber.Name() != "NUMBER" {
+		t.Fatalf("Expected NUMBER but got %q", tNumber.Name())
+	}
+	if tMinus.Category() != "operator" {
+		t.Fatalf("Expected operator but got %q", tMinus.Category())
+	}
+	if TokenType(199).Name() != "" {
+		t.Fatalf("Expected empty name but got %q", TokenType(199).Name())
+	}
+
+	err = Register([]TokenSpec{{tPlus, "ADD", "operator"}})
+	if err == nil {
+		t.Fatal("Expected duplicate error but got none")
+	}
+	if tPlus.Name() != "PLUS" {
+		t.Fatalf("Expected PLUS but got %q", tPlus.Name())
+	}
+
+	err = Register([]TokenSpec{{150, "A", ""}, {150, "B", ""}})
+	if err == nil {
+		t.Fatal("Expected duplicate error but got none")
+	}
+	if TokenType(150).Name() != "" {
+		t.Fatalf("Expected nothing registered but got %q", TokenType(150).Name())
+	}
+}
+
+func TestStrictTokenTypes(t *testing.T) {
+	const (
+		tKnown TokenType = iota + 200
+		tUnknown
+	)
+	t.Cleanup(func() { unregister(tKnown) })
+	if err := Register([]TokenSpec{{Type: tKnown, Name: "KNOWN"}}); err != nil {
+		t.Fatalf("Expected no error but got %s", err)
+	}
+
+	cases := []struct {
+		typ      TokenType
+		strict   bool
+		expected TokenType
+	}{
+		{tKnown, true, tKnown},
+		{tUnknown, true, ErrorToken},
+		{tUnknown, false, tUnknown},
+	}
+
+	for _, c := range cases {
+		var opts []Option
+		if c.strict {
+			opts = append(opts, WithStrictTokenTypes())
+		}
+		l := New("a", func(l *Lexer) StateFunc {
+			l.Next()
+			l.Emit(c.typ)
+			return nil
+		}, opts...)
+		l.StartSync()
+		tok, _ := l.NextToken()
+		if tok.Type != c.expected {
+			t.Fatalf("Expected %d but got %v", c.expected, *tok)
+		}
+	}
+}
+
+func TestStrictSignificantWhitespace(t *testing.T) {
+	l := New("  ", func(l *Lexer) StateFunc {
+		l.SetWhitespaceSignificant(true)
+		l.SkipWhitespace()
+		return nil
+	}, WithStrictTokenTypes())
+	l.StartSync()
+	tok, _ := l.NextToken()
+	if tok.Type != WhitespaceToken {
+		t.Fatalf("Expected a whitespace token but got %v", *tok)
+	}
+}
+
+func TestRegisterTokenName(t *testing.T) {
+	const (
+		tIdent TokenType = iota + 300
+		tString
+		tOther
+	)
+	RegisterTokenName(tIdent, "IDENT")
+	RegisterTokenName(tString, "STRING")
+
+	if s := (Token{Type: tIdent, Value: "hello"}).String(); s != "[IDENT] hello" {
+		t.Fatalf("Expected %q but got %q", "[IDENT] hello", s)
+	}
+	if s := tString.String(); s != "STRING" {
+		t.Fatalf("Expected STRING but got %q", s)
+	}
+	if s := (Token{Type: tOther, Value: "x"}).String(); s != "[302] x" {
+		t.Fatalf("Expected %q but got %q", "[302] x", s)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build go1.23
+
+package lexer
+
+import "iter"
+
+// Seq starts the lexer and returns an iterator over its tokens, including
+// error tokens. The lexer is stopped if the loop ends early.
+func (l *Lexer) Seq() iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		l.Start()
+		defer func() {
+			l.stop()
+			for range l.tokens {
+			}
+		}()
+		for tok, ok := l.receive(); ok; tok, ok = l.receive() {
+			if !yield(tok) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build go1.23
+
+package lexer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSeq(t *testing.T) {
+	var got []Token
+	for tok := range New("1 2 3", commentState).Seq() {
+		got = append(got, tok)
+	}
+
+	l := New("1 2 3", commentState)
+	l.Start()
+	expected := collect(l)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v but got %v", expected, got)
+	}
+
+	l = New(strings.Repeat("1 ", 1000), commentState, WithBufferSize(2))
+	n := 0
+	for range l.Seq() {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	waitClosed(t, l)
+	l = New(strings.Repeat("1 ", 100), commentState, WithBufferSize(1), WithTrivia())
+	for range l.Seq() {
+		break
+	}
+	waitClosed(t, l)
+}
+
+func TestSeqEndToken(t *testing.T) {
+	var last Token
+	n := 0
+	for tok := range New("1 2", commentState, WithEndMode(EndToken)).Seq() {
+		last = tok
+		n++
+	}
+	if n != 3 || last.Type != EOFToken || last.Value != "" {
+		t.Fatalf("Expected 2 tokens and an EOF token but got %d ending %v", n, last)
+	}
+}
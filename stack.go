@@ -2,6 +2,7 @@ package lexer
 
 type stackNode struct {
 	r    rune
+	w    int
 	next *stackNode
 }
 
@@ -13,8 +14,8 @@ func newStack() stack {
 	return stack{}
 }
 
-func (s *stack) push(r rune) {
-	node := &stackNode{r: r}
+func (s *stack) push(r rune, w int) {
+	node := &stackNode{r: r, w: w}
 	if s.start == nil {
 		s.start = node
 	} else {
@@ -23,16 +24,44 @@ func (s *stack) push(r rune) {
 	}
 }
 
-func (s *stack) pop() rune {
+func (s *stack) pop() (rune, int) {
 	if s.start == nil {
-		return EOFRune
+		return EOFRune, 0
 	}
 
 	n := s.start
 	s.start = n.next
-	return n.r
+	return n.r, n.w
+}
+
+func (s *stack) peek() rune {
+	if s.start == nil {
+		return EOFRune
+	}
+	return s.start.r
 }
 
 func (s *stack) clear() {
 	s.start = nil
 }
+
+// keep returns a copy of the stack holding at most the n most recent runes,
+// dropping EOF entries.
+func (s *stack) keep(n int) stack {
+	var out stack
+	var last *stackNode
+	for node := s.start; node != nil && n > 0; node = node.next {
+		if node.r == EOFRune {
+			continue
+		}
+		copied := &stackNode{r: node.r, w: node.w}
+		if last == nil {
+			out.start = copied
+		} else {
+			last.next = copied
+		}
+		last = copied
+		n--
+	}
+	return out
+}
@@ -6,13 +6,52 @@ import (
 
 func TestStack(t *testing.T) {
 	s := newStack()
-	s.push('r')
-	r := s.pop()
+	s.push('r', 1)
+	r, w := s.pop()
 	if r != 'r' {
 		t.Fatalf("Expected r but got %b", r)
 	}
-	r = s.pop()
+	if w != 1 {
+		t.Fatalf("Expected width 1 but got %d", w)
+	}
+	r, _ = s.pop()
 	if r != EOFRune {
 		t.Fatalf("Expected EOFRune but got %b", r)
 	}
 }
+
+func TestStackPeek(t *testing.T) {
+	s := newStack()
+	if r := s.peek(); r != EOFRune {
+		t.Fatalf("Expected EOFRune but got %b", r)
+	}
+	s.push('r', 1)
+	if r := s.peek(); r != 'r' {
+		t.Fatalf("Expected r but got %b", r)
+	}
+	if r, _ := s.pop(); r != 'r' {
+		t.Fatalf("Expected r but got %b", r)
+	}
+}
+
+func TestStackKeep(t *testing.T) {
+	s := newStack()
+	s.push('a', 1)
+	s.push('b', 1)
+	s.push(EOFRune, 0)
+	s.push('c', 2)
+
+	k := s.keep(2)
+	if r, w := k.pop(); r != 'c' || w != 2 {
+		t.Fatalf("Expected c of width 2 but got %q of %d", r, w)
+	}
+	if r, _ := k.pop(); r != 'b' {
+		t.Fatalf("Expected b but got %q", r)
+	}
+	if r, _ := k.pop(); r != EOFRune {
+		t.Fatalf("Expected EOFRune but got %q", r)
+	}
+	if r := s.peek(); r != 'c' {
+		t.Fatalf("Expected the original to be unchanged but got %q", r)
+	}
+}
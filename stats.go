@@ -0,0 +1,28 @@
+package lexer
+
+import "time"
+
+// LexStats describes a timed run of the lexer.
+type LexStats struct {
+	Tokens   int
+	Bytes    int
+	Duration time.Duration
+}
+
+// StartSyncTimed is StartSync recording the statistics returned by Stats.
+func (l *Lexer) StartSyncTimed() {
+	began := time.Now()
+	l.sent = 0
+	from := l.position
+	l.StartSync()
+	l.stats = LexStats{
+		Tokens:   l.sent,
+		Bytes:    l.position - from,
+		Duration: time.Since(began),
+	}
+}
+
+// Stats returns the statistics of the last run started with StartSyncTimed.
+func (l *Lexer) Stats() LexStats {
+	return l.stats
+}
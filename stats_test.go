@@ -0,0 +1,24 @@
+package lexer
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	l := New("1 22 333 x", commentState, WithBufferSize(8))
+	if s := l.Stats(); s != (LexStats{}) {
+		t.Fatalf("Expected no stats before running but got %+v", s)
+	}
+	l.StartSyncTimed()
+
+	s := l.Stats()
+	if s.Tokens != 3 {
+		t.Fatalf("Expected 3 tokens but got %d", s.Tokens)
+	}
+	if s.Bytes != 10 {
+		t.Fatalf("Expected 10 bytes but got %d", s.Bytes)
+	}
+	if s.Duration <= 0 {
+		t.Fatalf("Expected a positive duration but got %s", s.Duration)
+	}
+}
@@ -0,0 +1,65 @@
+package lexer
+
+import (
+	"context"
+	"fmt"
+)
+
+// Stream runs the lexer asynchronously and calls handler for each token. Only
+// the tokens in the channel buffer are held in memory. It returns the first
+// error from handler, the first error token or the context error if ctx is
+// cancelled. The lexer is stopped when Stream returns.
+func (l *Lexer) Stream(ctx context.Context, handler func(Token) error) error {
+	l.Start()
+	defer l.stop()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case tok, ok := <-l.tokens:
+			if !ok {
+				final, done := l.end()
+				if done {
+					return nil
+				}
+				tok = *final
+			}
+			if tok.Type == ErrorToken {
+				return fmt.Errorf("%s: %s", tok.Start, tok.Value)
+			}
+			if err := handler(tok); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NextTokenContext is NextToken returning the context error if ctx is
+// cancelled first. The lexer is stopped on cancellation so that a running
+// lexer does not block forever sending tokens.
+func (l *Lexer) NextTokenContext(ctx context.Context) (*Token, bool, error) {
+	if err := ctx.Err(); err != nil {
+		l.stop()
+		return nil, true, err
+	}
+	if len(l.lookahead) > 0 {
+		tok, done := l.NextToken()
+		return tok, done, nil
+	}
+	select {
+	case <-ctx.Done():
+		l.stop()
+		return nil, true, ctx.Err()
+	case tok, ok := <-l.tokens:
+		if !ok {
+			tok, done := l.end()
+			l.last = tok
+			return tok, done, nil
+		}
+		l.last = &tok
+		return &tok, false, nil
+	}
+}
@@ -0,0 +1,191 @@
+package lexer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitClosed(t *testing.T, l *Lexer) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-l.tokens:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the lexer to stop")
+		}
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	l := New(strings.Repeat("1 ", 1000), commentState, WithBufferSize(2))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := 0
+	err := l.Stream(ctx, func(Token) error {
+		n++
+		if n == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled but got %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 tokens handled but got %d", n)
+	}
+	waitClosed(t, l)
+}
+
+func TestStreamCancelTrivia(t *testing.T) {
+	l := New(strings.Repeat("1 ", 100), commentState, WithBufferSize(1), WithTrivia())
+	ctx, cancel := context.WithCancel(context.Background())
+	err := l.Stream(ctx, func(Token) error {
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled but got %v", err)
+	}
+	waitClosed(t, l)
+}
+
+func TestStreamHandlerError(t *testing.T) {
+	l := New(strings.Repeat("1 ", 1000), commentState, WithBufferSize(2))
+	expected := errors.New("stop")
+
+	n := 0
+	err := l.Stream(context.Background(), func(Token) error {
+		n++
+		if n == 2 {
+			return expected
+		}
+		return nil
+	})
+	if err != expected {
+		t.Fatalf("Expected %v but got %v", expected, err)
+	}
+	waitClosed(t, l)
+}
+
+func TestStreamLexError(t *testing.T) {
+	l := New("notaspace", WhitespaceState)
+	err := l.Stream(context.Background(), func(Token) error { return nil })
+	if err == nil || !strings.HasPrefix(err.Error(), "1:1: ") {
+		t.Fatalf("Expected a lexing error at 1:1 but got %v", err)
+	}
+}
+
+func TestStreamLarge(t *testing.T) {
+	l := New(strings.Repeat("123 ", 100000), commentState, WithBufferSize(4))
+
+	n := 0
+	err := l.Stream(context.Background(), func(tok Token) error {
+		if tok.Value != "123" {
+			t.Fatalf("Expected 123 but got %q", tok.Value)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error but got %s", err)
+	}
+	if n != 100000 {
+		t.Fatalf("Expected 100000 tokens but got %d", n)
+	}
+	if cap(l.tokens) != 4 {
+		t.Fatalf("Expected a buffer of 4 but got %d", cap(l.tokens))
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	l := NewFromReader(strings.NewReader(strings.Repeat("123\n", 100000)), commentState, WithBufferSize(4))
+
+	n := 0
+	err := l.Stream(context.Background(), func(tok Token) error {
+		if tok.Value != "123" {
+			t.Fatalf("Expected 123 but got %q", tok.Value)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 100000 {
+		t.Fatalf("Expected 100000 tokens but got %d, %v", n, err)
+	}
+	if len(l.source) > 2*readSize || len(l.lines) > 2*readSize {
+		t.Fatalf("Expected the input to be discarded but kept %d bytes and %d lines", len(l.source), len(l.lines))
+	}
+}
+
+func TestNextTokenContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := New("1 2 3", commentState, WithBufferSize(4))
+	l.StartSync()
+	if tok, done, err := l.NextTokenContext(ctx); err != nil || done || tok.Value != "1" {
+		t.Fatalf("Expected 1 but got %v, %t, %v", tok, done, err)
+	}
+
+	cancel()
+	l = New("1 2 3", commentState, WithBufferSize(4))
+	l.StartSync()
+	if tok, done, err := l.NextTokenContext(ctx); err != context.Canceled || !done || tok != nil {
+		t.Fatalf("Expected context.Canceled but got %v, %t, %v", tok, done, err)
+	}
+
+	l = New("1", commentState)
+	if _, done, err := l.NextTokenContext(ctx); err != context.Canceled || !done {
+		t.Fatalf("Expected context.Canceled before starting but got %t, %v", done, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	l = New(strings.Repeat("1 ", 1000), commentState, WithBufferSize(2))
+	l.Start()
+	l.NextTokenContext(ctx)
+	cancel()
+	if _, _, err := l.NextTokenContext(ctx); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled but got %v", err)
+	}
+	waitClosed(t, l)
+}
+
+func TestEmitTimeout(t *testing.T) {
+	l := New(strings.Repeat("1 ", 100), commentState, WithBufferSize(2), WithEmitTimeout(10*time.Millisecond))
+	l.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	l.NextToken()
+	l.NextToken()
+	tok, done := l.NextToken()
+	if done || !tok.IsError() || tok.Value != "emit timed out after 10ms" {
+		t.Fatalf("Expected a timeout error after the 2 buffered tokens but got %v", tok)
+	}
+	if l.Err() == nil {
+		t.Fatal("Expected Err to report the timeout")
+	}
+	if _, done := l.NextToken(); !done {
+		t.Fatal("Expected done after the error")
+	}
+}
+
+func TestDone(t *testing.T) {
+	l := New("1 2 3", commentState, WithBufferSize(4))
+	l.Start()
+	select {
+	case <-l.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the lexer to finish")
+	}
+	if n := len(collect(l)); n != 3 {
+		t.Fatalf("Expected 3 tokens but got %d", n)
+	}
+	if _, ok := <-l.Tokens(); ok {
+		t.Fatal("Expected the tokens channel to be closed")
+	}
+}